@@ -0,0 +1,363 @@
+package streamquote
+
+import (
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// ConvertToSlice converts src like Convert does with the default options,
+// writing as much of the converted data to dst as fits.
+// It returns the number of bytes written to dst, and whether all of src
+// was converted. Escape sequences and runes are never split, so if
+// ok is false, written may be less than len(dst).
+func ConvertToSlice(dst []byte, src []byte) (written int, ok bool) {
+	var scratch [10]byte
+	for len(src) > 0 {
+		escaped, width := escapeNext(&scratch, src)
+		if len(escaped) > len(dst)-written {
+			return written, false
+		}
+		written += copy(dst[written:], escaped)
+		src = src[width:]
+	}
+	return written, true
+}
+
+// AppendQuoteStats appends the double-quoted Go string literal representing
+// src to dst, like strconv.AppendQuote, and returns the extended buffer and
+// the number of valid runes that were escaped, like Stats.RunesEscaped.
+// Invalid bytes are escaped too, but they are not counted.
+func AppendQuoteStats(dst []byte, src []byte) (out []byte, escaped int) {
+	dst = append(dst, '"')
+	for len(src) > 0 {
+		r, width := utf8.DecodeRune(src)
+		switch {
+		case width == 1 && r == utf8.RuneError:
+			dst = appendEscapedByte(dst, src[0], lowerhex)
+		case needsEscape(r, '"', false):
+			dst = appendEscapedRune(dst, r, '"', false, &goStyle)
+			escaped++
+		default:
+			dst = append(dst, src[:width]...)
+		}
+		src = src[width:]
+	}
+	return append(dst, '"'), escaped
+}
+
+// maxExpansion is the maximum number of output bytes per input byte
+// with the default options: an invalid or control byte becomes \xHH.
+const maxExpansion = 4
+
+// EstimateQuotedLen returns an upper bound of the length of src
+// converted with the default options, including room for the quotes
+// added by WithQuotes. It only depends on the length of src, use
+// EstimateQuotedLenExact to get the exact length.
+func EstimateQuotedLen(src []byte) int {
+	return maxExpansion*len(src) + 2
+}
+
+// EstimateQuotedLenExact returns the exact length of src converted with
+// the default options, without quotes. It has to scan all of src.
+func EstimateQuotedLenExact(src []byte) int {
+	var scratch [10]byte
+	n := 0
+	for len(src) > 0 {
+		escaped, width := escapeNext(&scratch, src)
+		n += len(escaped)
+		src = src[width:]
+	}
+	return n
+}
+
+// escapeNext escapes the first rune in src with the default options.
+// It returns the escaped rune, which is either in scratch or in src,
+// and the number of bytes it took up in src.
+func escapeNext(scratch *[10]byte, src []byte) ([]byte, int) {
+	r, width := utf8.DecodeRune(src)
+	if width == 1 && r == utf8.RuneError {
+		return appendEscapedByte(scratch[:0], src[0], lowerhex), width
+	}
+	if needsEscape(r, '"', false) {
+		return appendEscapedRune(scratch[:0], r, '"', false, &goStyle), width
+	}
+	return src[:width], width
+}
+
+// An Escaper decides how the runes of the input are written,
+// see WithEscaper.
+type Escaper interface {
+	// Escape appends the converted form of r to dst, and returns the
+	// extended buffer. raw is the UTF-8 encoding of r in the input.
+	// A byte that is not valid UTF-8 is passed as utf8.RuneError,
+	// with raw holding just that byte.
+	Escape(dst []byte, r rune, raw []byte) []byte
+}
+
+// DefaultEscaper is the Escaper that escapes like Convert does
+// with the default options.
+var DefaultEscaper Escaper = goEscaper{}
+
+// goEscaper escapes runes like strconv.Quote.
+type goEscaper struct{}
+
+func (goEscaper) Escape(dst []byte, r rune, raw []byte) []byte {
+	if len(raw) == 1 && r == utf8.RuneError {
+		return appendEscapedByte(dst, raw[0], lowerhex)
+	}
+	if needsEscape(r, '"', false) {
+		return appendEscapedRune(dst, r, '"', false, &goStyle)
+	}
+	return append(dst, raw...)
+}
+
+// htmlEntities are the entities used for characters
+// that are special in HTML, like html.EscapeString.
+var htmlEntities = [...]string{
+	'<':  "&lt;",
+	'>':  "&gt;",
+	'&':  "&amp;",
+	'\'': "&#39;",
+	'"':  "&#34;",
+}
+
+// newSafeTable returns a table of the printable ASCII bytes that are
+// never escaped if the delimiter is quote.
+func newSafeTable(quote rune) (safe [256]bool) {
+	for b := ' '; b < 0x7f; b++ {
+		safe[b] = b != quote && b != '\\'
+	}
+	return
+}
+
+// newPercentSafeTable returns a table of the bytes that are not
+// percent-encoded: the unreserved characters of RFC 3986,
+// and the bytes in extra.
+func newPercentSafeTable(extra string) (safe [256]bool) {
+	for b := 'a'; b <= 'z'; b++ {
+		safe[b] = true
+		safe[b-'a'+'A'] = true
+	}
+	for b := '0'; b <= '9'; b++ {
+		safe[b] = true
+	}
+	for _, b := range []byte("-._~" + extra) {
+		safe[b] = true
+	}
+	return
+}
+
+// newByteRangeSafeTable returns a table of the bytes
+// that are not in any of the ranges.
+func newByteRangeSafeTable(ranges []ByteRange) (safe [256]bool) {
+	for b := range safe {
+		safe[b] = true
+	}
+	for _, r := range ranges {
+		for b := int(r.First); b <= int(r.Last); b++ {
+			safe[b] = false
+		}
+	}
+	return
+}
+
+// asciiRun returns the length of the run of safe bytes
+// at the start of data, up to max.
+func asciiRun(data []byte, max int, safe *[256]bool) int {
+	if len(data) > max {
+		data = data[:max]
+	}
+	for i, b := range data {
+		if !safe[b] {
+			return i
+		}
+	}
+	return len(data)
+}
+
+// appendRune appends the UTF-8 encoding of r to dst.
+func appendRune(dst []byte, r rune) []byte {
+	var runeBuf [utf8.UTFMax]byte
+	width := utf8.EncodeRune(runeBuf[:], r)
+	return append(dst, runeBuf[:width]...)
+}
+
+// appendEscapedByte appends the \xHH escape sequence for b to dst,
+// using the given hex digits.
+func appendEscapedByte(dst []byte, b byte, hex string) []byte {
+	return append(dst, '\\', 'x', hex[b>>4], hex[b&0xF])
+}
+
+// appendInvalidByte appends the escape sequence for the byte b,
+// which is not valid UTF-8, to dst.
+func appendInvalidByte(dst []byte, b byte, style *escapeStyle) []byte {
+	if style.csv {
+		return append(dst, b)
+	}
+	if style.js {
+		// \xHH is U+00HH in JavaScript, and there's no byte escape
+		return appendInvalidRune(dst, style)
+	}
+	if style.python {
+		// \xHH is U+00HH in Python, so use the surrogate escape of PEP 383
+		return append(dst, '\\', style.prefix.letter('u'), style.hex[0xd], style.hex[0xc], style.hex[b>>4], style.hex[b&0xF])
+	}
+	return appendEscapedByte(dst, b, style.hex)
+}
+
+// escapeStyle controls how escape sequences are spelled.
+type escapeStyle struct {
+	// hex are the 16 digits used in hex escape sequences.
+	hex    string
+	prefix UEscapePrefix
+	// python selects the escape sequences of Python 3 string literals
+	python bool
+	// js selects the escape sequences of JavaScript string literals
+	js bool
+	// csv doubles the quote character, and writes everything else raw
+	csv bool
+	// surrogatePairs escapes runes above U+FFFF as two \uHHHH
+	// escape sequences, like js does
+	surrogatePairs bool
+	// short overrides the short escape sequences of control characters,
+	// an empty sequence disables the short escape
+	short map[rune][]byte
+}
+
+// goStyle spells escape sequences like strconv.Quote.
+var goStyle = escapeStyle{hex: lowerhex}
+
+// EscapeRune appends r to dst, escaping it if necessary, using the same
+// rules as Convert, and returns the extended buffer.
+// The double quote and the backslash are always backslashed.
+// If ascii is true, all non-ASCII runes are escaped as well.
+func EscapeRune(dst []byte, r rune, ascii bool) []byte {
+	return appendEscapedRune(dst, r, '"', ascii, &goStyle)
+}
+
+// isPrint reports whether r can be written without escaping.
+// If ascii is true, only printable ASCII runes can.
+func isPrint(r rune, ascii bool) bool {
+	if ascii {
+		return r < utf8.RuneSelf && strconv.IsPrint(r)
+	}
+	return strconv.IsPrint(r)
+}
+
+// isControl reports whether r is a C0 or C1 control character,
+// or DEL.
+func isControl(r rune) bool {
+	return r < ' ' || r >= 0x7f && r < 0xa0
+}
+
+// needsEscape reports whether r has to be escaped.
+// The quote character and the backslash are always backslashed.
+func needsEscape(r rune, quote rune, ascii bool) bool {
+	return r == quote || r == '\\' || !isPrint(r, ascii)
+}
+
+// appendEscapedRune appends r to dst, escaping it if necessary,
+// spelling escape sequences in the given style.
+// The quote character and the backslash are always backslashed.
+func appendEscapedRune(dst []byte, r rune, quote rune, ascii bool, style *escapeStyle) []byte {
+	if r < 0 || r > utf8.MaxRune {
+		return appendInvalidRune(dst, style)
+	}
+	if style.csv {
+		if r == quote {
+			dst = append(dst, '"')
+		}
+		return appendRune(dst, r)
+	}
+	if r == quote || r == '\\' { // always backslashed
+		dst = append(dst, '\\')
+		return appendRune(dst, r)
+	}
+	if isPrint(r, ascii) {
+		return appendRune(dst, r)
+	}
+	return appendEscape(dst, r, style)
+}
+
+// appendEscape appends the escape sequence of the valid rune r to dst,
+// even if r is printable, spelled in the given style.
+func appendEscape(dst []byte, r rune, style *escapeStyle) []byte {
+	short, overridden := style.short[r]
+	if len(short) > 0 {
+		return append(dst, short...)
+	}
+	if style.python && r < 0x100 && r != '\n' && r != '\r' && r != '\t' {
+		// like repr in Python
+		return appendEscapedByte(dst, byte(r), style.hex)
+	}
+	switch {
+	case overridden:
+	case r == '\a' && style.js:
+		// there's no \a in JavaScript
+	default:
+		if escape := shortEscape(r); escape != 0 {
+			return append(dst, '\\', escape)
+		}
+	}
+	switch {
+	case r < ' ' || r == 0x7f:
+		return appendEscapedByte(dst, byte(r), style.hex)
+	case r < 0x10000:
+		dst = appendUEscape(dst, r, style)
+	case style.js || style.surrogatePairs:
+		// JavaScript only has \uHHHH, use a surrogate pair
+		r1, r2 := utf16.EncodeRune(r)
+		dst = appendUEscape(dst, r1, style)
+		dst = appendUEscape(dst, r2, style)
+	default:
+		dst = append(dst, '\\', style.prefix.letter('U'))
+		for s := 28; s >= 0; s -= 4 {
+			dst = append(dst, style.hex[r>>uint(s)&0xF])
+		}
+	}
+	return dst
+}
+
+// shortEscape returns the letter of the short escape sequence of r,
+// like n for \n, or 0 if it doesn't have one.
+func shortEscape(r rune) byte {
+	switch r {
+	case '\a':
+		return 'a'
+	case '\b':
+		return 'b'
+	case '\f':
+		return 'f'
+	case '\n':
+		return 'n'
+	case '\r':
+		return 'r'
+	case '\t':
+		return 't'
+	case '\v':
+		return 'v'
+	}
+	return 0
+}
+
+// appendInvalidRune appends the escape sequence used for runes that
+// are not Unicode code points to dst: the replacement character U+FFFD
+// is escaped in all modes, so that the output shows that the input
+// was invalid.
+func appendInvalidRune(dst []byte, style *escapeStyle) []byte {
+	if style.csv {
+		return appendRune(dst, utf8.RuneError)
+	}
+	return appendUEscape(dst, utf8.RuneError, style)
+}
+
+// appendUEscape appends the \uHHHH escape sequence for r,
+// which must be less than 0x10000, to dst.
+func appendUEscape(dst []byte, r rune, style *escapeStyle) []byte {
+	dst = append(dst, '\\', style.prefix.letter('u'))
+	for s := 12; s >= 0; s -= 4 {
+		dst = append(dst, style.hex[r>>uint(s)&0xF])
+	}
+	return dst
+}
@@ -0,0 +1,148 @@
+package streamquote
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestEscapeRune(t *testing.T) {
+	test := func(r rune) {
+		if !utf8.ValidRune(r) {
+			return
+		}
+		expected := strconv.Quote(string(r))
+		expected = expected[1 : len(expected)-1]
+		if out := string(EscapeRune(nil, r, false)); !testEqual(out, expected) {
+			t.Errorf("EscapeRune(%U, false) = %s, want %s", r, out, expected)
+		}
+
+		expected = strconv.QuoteToASCII(string(r))
+		expected = expected[1 : len(expected)-1]
+		if out := string(EscapeRune(nil, r, true)); !testEqual(out, expected) {
+			t.Errorf("EscapeRune(%U, true) = %s, want %s", r, out, expected)
+		}
+	}
+
+	for r := rune(0); r < 0x3000; r++ {
+		test(r)
+	}
+	for _, r := range quoterunetests {
+		test(r)
+	}
+}
+
+func TestEscapeRuneAppends(t *testing.T) {
+	dst := []byte("abc")
+	dst = EscapeRune(dst, '\n', false)
+	dst = EscapeRune(dst, 0x263a, false)
+	dst = EscapeRune(dst, 0x263a, true)
+	expected := `abc\n☺\u263a`
+	if string(dst) != expected {
+		t.Errorf("Expected %s, got %s", expected, dst)
+	}
+}
+
+// TestEscapeRuneOutOfRange tests that runes outside of the Unicode range
+// are escaped as the replacement character.
+func TestEscapeRuneOutOfRange(t *testing.T) {
+	for _, r := range []rune{utf8.MaxRune + 1, 0x7fffffff, -1, -0x80000000} {
+		for _, ascii := range []bool{false, true} {
+			out := EscapeRune(nil, r, ascii)
+			if string(out) != `\ufffd` {
+				t.Errorf("EscapeRune(%d, %v) = %s, want \\ufffd", r, ascii, out)
+			}
+		}
+	}
+}
+
+func TestConvertToSlice(t *testing.T) {
+	for _, tt := range quotetests {
+		expected := tt.out[1 : len(tt.out)-1]
+		dst := make([]byte, len(expected)+1)
+		n, ok := ConvertToSlice(dst, []byte(tt.in))
+		if !ok {
+			t.Errorf("ConvertToSlice(%s) didn't fit", tt.in)
+		}
+		if out := string(dst[:n]); !testEqual(out, expected) {
+			t.Errorf("ConvertToSlice(%s) = %s, want %s", tt.in, out, expected)
+		}
+	}
+}
+
+// TestConvertToSliceTooSmall tests that escapes are not split
+// if dst is too small.
+func TestConvertToSliceTooSmall(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"ab\n", "ab"},
+		{"a\u00a0", "a"},
+		{"a\U0010ffff", "a"},
+		{"a\xff", "a"},
+		{"a\u263a", "a"},
+		{"ab", "a"},
+	}
+
+	for _, tt := range tests {
+		var converted bytes.Buffer
+		New().Convert(strings.NewReader(tt.in), &converted)
+		// one byte too small
+		dst := make([]byte, converted.Len()-1)
+		n, ok := ConvertToSlice(dst, []byte(tt.in))
+		if ok {
+			t.Errorf("ConvertToSlice(%q) should not fit in %d bytes", tt.in, len(dst))
+		}
+		if out := string(dst[:n]); out != tt.expected {
+			t.Errorf("ConvertToSlice(%q) = %s, want %s", tt.in, out, tt.expected)
+		}
+
+		dst = make([]byte, converted.Len())
+		n, ok = ConvertToSlice(dst, []byte(tt.in))
+		if !ok || n != len(dst) {
+			t.Errorf("ConvertToSlice(%q) should fit in %d bytes", tt.in, len(dst))
+		}
+	}
+}
+
+func TestEstimateQuotedLen(t *testing.T) {
+	inputs := []string{"", strings.Repeat("\x01", 100), strings.Repeat("\xff", 100)}
+	for _, tt := range quotetests {
+		inputs = append(inputs, tt.in)
+	}
+	for _, in := range inputs {
+		var converted bytes.Buffer
+		New().Convert(strings.NewReader(in), &converted)
+		if exact := EstimateQuotedLenExact([]byte(in)); exact != converted.Len() {
+			t.Errorf("EstimateQuotedLenExact(%q) = %d, want %d", in, exact, converted.Len())
+		}
+		if estimate := EstimateQuotedLen([]byte(in)); estimate < converted.Len()+2 {
+			t.Errorf("EstimateQuotedLen(%q) = %d, want at least %d", in, estimate, converted.Len()+2)
+		}
+	}
+}
+
+func TestAppendQuoteStats(t *testing.T) {
+	converter := New()
+	inputs := []string{"", "abc", "a\nb\tc", "\xff\xfe☺", "\"\\", "\u00ad\U0010ffff\x7f"}
+	for _, tt := range quotetests {
+		inputs = append(inputs, tt.in)
+	}
+	for _, in := range inputs {
+		out, escaped := AppendQuoteStats([]byte("x"), []byte(in))
+		if expected := "x" + strconv.Quote(in); !testEqual(string(out), expected) {
+			t.Errorf("AppendQuoteStats(%q) = %s, want %s", in, out, expected)
+		}
+		stats, err := converter.ConvertStats(strings.NewReader(in), ioutil.Discard)
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if escaped != stats.RunesEscaped {
+			t.Errorf("AppendQuoteStats(%q) escaped %d runes, ConvertStats %d", in, escaped, stats.RunesEscaped)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package streamquote
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// ConvertFile converts the contents of the file at srcPath, writing the
+// result to a new file at dstPath, which is truncated if it exists.
+// If the conversion fails, the file at dstPath is removed.
+func ConvertFile(srcPath, dstPath string, opts ...Option) (err error) {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(dstPath)
+		}
+	}()
+
+	// the converter buffers its output, so dst doesn't need a bufio.Writer
+	_, err = New(opts...).Convert(src, dst)
+	return err
+}
+
+// ConvertRotating converts the data in "in", writing it to a sequence of
+// writers, like rotated log files, each holding at most maxBytes bytes.
+// newFile is called with 0 for the first writer, and with the next number
+// whenever the current one is full, after closing it. Escape sequences and
+// runes are never split between writers, so a writer may hold less than
+// maxBytes, or more, if a single escape sequence doesn't fit. Concatenated,
+// the writers hold the same output as Convert would write. The last writer
+// is closed too, even if the conversion fails.
+func ConvertRotating(in io.Reader, newFile func(seq int) (io.WriteCloser, error), maxBytes int64, opts ...Option) (written int, err error) {
+	if maxBytes < 1 {
+		return 0, fmt.Errorf("streamquote: invalid file size %d", maxBytes)
+	}
+	seq := 0
+	file, err := newFile(seq)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if file == nil {
+			return
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	c := newConverter(opts...)
+	c.rotateSize = maxBytes
+	c.rotate = func() (io.Writer, error) {
+		err := file.Close()
+		file = nil
+		if err != nil {
+			return nil, err
+		}
+		seq++
+		next, err := newFile(seq)
+		if err != nil {
+			return nil, err
+		}
+		file = next
+		return file, nil
+	}
+	return c.Convert(in, file)
+}
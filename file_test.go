@@ -0,0 +1,164 @@
+package streamquote
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"testing/iotest"
+)
+
+func TestConvertFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "streamquote")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	in := "abc\n☺\xff"
+	srcPath := filepath.Join(dir, "src")
+	dstPath := filepath.Join(dir, "dst")
+	if err := ioutil.WriteFile(srcPath, []byte(in), 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+
+	if err := ConvertFile(srcPath, dstPath, WithQuotes()); err != nil {
+		t.Fatalf("ConvertFile failed: %v", err)
+	}
+	out, err := ioutil.ReadFile(dstPath)
+	if err != nil {
+		t.Fatalf("Failed to read destination file: %v", err)
+	}
+	if expected := strconv.Quote(in); string(out) != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+
+	err = ConvertFile(srcPath, dstPath, WithMaxOutput(4))
+	if err != ErrOutputTooLarge {
+		t.Fatalf("Expected %v, got %v", ErrOutputTooLarge, err)
+	}
+	if _, err := os.Stat(dstPath); !os.IsNotExist(err) {
+		t.Errorf("Expected destination file to be removed, got %v", err)
+	}
+
+	err = ConvertFile(filepath.Join(dir, "missing"), dstPath)
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected a not exist error, got %v", err)
+	}
+}
+
+func TestStripBOMFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "streamquote")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src.txt")
+	dst := filepath.Join(dir, "dst.txt")
+	if err := ioutil.WriteFile(src, []byte("\ufeffline 1\n\ufeffline 2\n"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := ConvertFile(src, dst, WithStripBOM()); err != nil {
+		t.Fatalf("ConvertFile failed: %v", err)
+	}
+	out, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if expected := `line 1\n\ufeffline 2\n`; string(out) != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+}
+
+// memoryFile is an in-memory io.WriteCloser.
+type memoryFile struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (f *memoryFile) Close() error {
+	if f.closed {
+		return errors.New("closed twice")
+	}
+	f.closed = true
+	return nil
+}
+
+func TestConvertRotating(t *testing.T) {
+	in, err := ioutil.ReadAll(io.LimitReader(generateLargeString(), 100000))
+	if err != nil {
+		t.Fatalf("Failed to read large string: %v", err)
+	}
+	expected := strconv.Quote(string(in))
+
+	const maxBytes = 1000
+	var files []*memoryFile
+	newFile := func(seq int) (io.WriteCloser, error) {
+		if seq != len(files) {
+			t.Errorf("Expected file %d, got %d", len(files), seq)
+		}
+		files = append(files, &memoryFile{})
+		return files[len(files)-1], nil
+	}
+	n, err := ConvertRotating(bytes.NewReader(in), newFile, maxBytes, WithQuotes())
+	if err != nil {
+		t.Fatalf("ConvertRotating failed: %v", err)
+	}
+	if n != len(expected) {
+		t.Errorf("Expected %d bytes, got %d", len(expected), n)
+	}
+	if len(files) < 2 {
+		t.Fatalf("Expected several files, got %d", len(files))
+	}
+	var out bytes.Buffer
+	for i, f := range files {
+		if !f.closed {
+			t.Errorf("File %d was not closed", i)
+		}
+		if i < len(files)-1 && (f.Len() > maxBytes || f.Len() < maxBytes-len(`\U0010ffff`)) {
+			t.Errorf("File %d has %d bytes", i, f.Len())
+		}
+		// no escape sequence is split, each file can be unquoted
+		content := f.String()
+		if i == 0 {
+			content = content[1:]
+		}
+		if i == len(files)-1 {
+			content = content[:len(content)-1]
+		}
+		if _, err := strconv.Unquote(`"` + content + `"`); err != nil {
+			t.Errorf("File %d can't be unquoted: %v", i, err)
+		}
+		out.Write(f.Bytes())
+	}
+	if out.String() != expected {
+		t.Errorf("The files don't add up to the quoted input")
+	}
+
+	// the last file is closed even if the conversion fails
+	files = nil
+	_, err = ConvertRotating(iotest.TimeoutReader(bytes.NewReader(in)), newFile, maxBytes)
+	if !errors.Is(err, iotest.ErrTimeout) {
+		t.Errorf("Expected %v, got %v", iotest.ErrTimeout, err)
+	}
+	for i, f := range files {
+		if !f.closed {
+			t.Errorf("File %d was not closed", i)
+		}
+	}
+
+	errCreate := errors.New("no more files")
+	_, err = ConvertRotating(bytes.NewReader(in), func(seq int) (io.WriteCloser, error) {
+		if seq == 2 {
+			return nil, errCreate
+		}
+		return &memoryFile{}, nil
+	}, maxBytes)
+	if err != errCreate {
+		t.Errorf("Expected %v, got %v", errCreate, err)
+	}
+}
@@ -0,0 +1,38 @@
+//go:build go1.18
+// +build go1.18
+
+package streamquote
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+// FuzzConvert checks that Convert with WithQuotes produces the same
+// output as strconv.Quote. Both decide what's printable with the tables
+// of strconv, so they agree across Go versions, \x7f included.
+// Run it with go test -fuzz=FuzzConvert.
+func FuzzConvert(f *testing.F) {
+	for _, tt := range quotetests {
+		f.Add([]byte(tt.in))
+	}
+	f.Add([]byte("\xe2\x98"))
+	f.Add([]byte("\xed\xa0\x80"))
+	f.Add([]byte("\x00\x01­\U0010ffff\xff"))
+
+	converter := New(WithQuotes())
+	f.Fuzz(func(t *testing.T, in []byte) {
+		var buffer bytes.Buffer
+		n, err := converter.Convert(bytes.NewReader(in), &buffer)
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if expected := strconv.Quote(string(in)); buffer.String() != expected {
+			t.Errorf("Convert(%q) = %s, want %s", in, buffer.String(), expected)
+		}
+		if n != buffer.Len() {
+			t.Errorf("Convert(%q) returned %d, wrote %d bytes", in, n, buffer.Len())
+		}
+	})
+}
@@ -0,0 +1,737 @@
+package streamquote
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"strings"
+	"unicode/utf8"
+)
+
+// Option configures a Quoter.
+type Option func(*Quoter)
+
+// WithMaxOutput limits the number of bytes Convert writes to n.
+// If the converted data would exceed the limit, Convert stops before writing
+// the escape sequence that would cross it, and returns ErrOutputTooLarge.
+// A limit of zero or less means no limit.
+func WithMaxOutput(n int64) Option {
+	return func(c *Quoter) {
+		c.maxOutput = n
+	}
+}
+
+// WithLineWrap makes Convert write continuation whenever a line of output
+// would otherwise exceed cols bytes. Escape sequences and multi-byte runes
+// are never split, so a line may be longer than cols if a single escape
+// sequence doesn't fit. If continuation is empty, a newline is used.
+// To produce a valid Go string literal spanning multiple lines,
+// use a continuation like "\" +\n\"".
+func WithLineWrap(cols int, continuation string) Option {
+	return func(c *Quoter) {
+		if continuation == "" {
+			continuation = "\n"
+		}
+		c.wrapCols = cols
+		c.continuation = []byte(continuation)
+	}
+}
+
+// WithExpandTabs makes Convert replace each tab with spaces up to the next
+// tab stop, every width columns, instead of escaping it. Columns are counted
+// in runes from the start of the output line, including the prefix and the
+// opening delimiter, so the tab stops line up for input that's written
+// as it is. Tabs are expanded before any other option is applied to them,
+// except for WithByteSlice, WithPercentEncoding and WithByteRanges, which
+// treat the input as bytes. A width of zero or less means no expansion.
+func WithExpandTabs(width int) Option {
+	return func(c *Quoter) {
+		c.tabWidth = width
+		if width > 0 {
+			c.tabSpaces = []byte(strings.Repeat(" ", width))
+		}
+	}
+}
+
+// WithFixedWidth makes Convert pad the output of each rune with spaces
+// to cols columns, so that every rune of the input takes up the same
+// number of columns. Columns are counted in runes, like with
+// WithExpandTabs. If the output of a rune is wider than cols, Convert
+// fails with an error wrapping ErrTooWide. With WithByteSlice,
+// WithPercentEncoding and WithByteRanges, each byte is padded instead.
+// Nothing is written for dropped input, so it isn't padded either.
+// A cols of zero or less means no padding.
+func WithFixedWidth(cols int) Option {
+	return func(c *Quoter) {
+		c.fixedWidth = cols
+		if cols > 0 {
+			c.fixedPad = []byte(strings.Repeat(" ", cols))
+		}
+	}
+}
+
+// WithBufferSize sets the size of the buffer the data read from the reader
+// is converted in, instead of DefaultBufferSize. It has to be at least
+// utf8.UTFMax, otherwise Convert fails with an error wrapping
+// ErrBufferTooSmall.
+func WithBufferSize(n int) Option {
+	return func(c *Quoter) {
+		if n < utf8.UTFMax {
+			c.setErr(fmt.Errorf("%w: %d bytes", ErrBufferTooSmall, n))
+			return
+		}
+		c.bufferSize = n
+	}
+}
+
+// WithReadChunkSize makes Convert read at most n bytes at a time, and
+// flush the converted data after each read, so that the output keeps up
+// with a slow reader, like a live log, at the cost of more, smaller reads
+// and writes. With WithFlushAlignment, only the aligned part is flushed. n has to be at least 1, otherwise Convert fails with an
+// error wrapping ErrBufferTooSmall.
+func WithReadChunkSize(n int) Option {
+	return func(c *Quoter) {
+		if n < 1 {
+			c.setErr(fmt.Errorf("%w: read chunk of %d bytes", ErrBufferTooSmall, n))
+			return
+		}
+		c.readChunk = n
+	}
+}
+
+// WithQuotes makes Convert add double quotes around the output,
+// producing a valid Go string literal like strconv.Quote.
+// Use WithDelimiter to use a different quote character.
+func WithQuotes() Option {
+	return func(c *Quoter) {
+		c.quotes = true
+	}
+}
+
+// WithDelimiter sets the string delimiter to r instead of the double quote.
+// The delimiter is always backslashed instead of the double quote,
+// and it's added around the output if WithQuotes is used.
+func WithDelimiter(r rune) Option {
+	return func(c *Quoter) {
+		c.delimiter = r
+	}
+}
+
+// WithASCII makes Convert escape all non-ASCII runes,
+// like strconv.QuoteToASCII.
+func WithASCII() Option {
+	return func(c *Quoter) {
+		c.ascii = true
+	}
+}
+
+// WithGraphic makes Convert write the runes that are graphic as defined by
+// strconv.IsGraphic as they are, like strconv.QuoteToGraphic. This includes
+// Unicode space characters like U+00A0, which are escaped by default.
+func WithGraphic() Option {
+	return func(c *Quoter) {
+		c.graphic = true
+	}
+}
+
+// WithMinimalEscaping makes Convert escape only what has to be escaped:
+// the C0 control characters (U+0000 to U+001F), DEL (U+007F) and the C1
+// control characters (U+0080 to U+009F), in addition to the delimiter and
+// the backslash, which are always backslashed, and invalid UTF-8.
+// All other runes are written as they are, including format characters
+// like zero width joiners, separators, private use and unassigned code
+// points, which are escaped by default and with WithGraphic.
+func WithMinimalEscaping() Option {
+	return func(c *Quoter) {
+		c.minimal = true
+	}
+}
+
+// WithLiteralWhitespace makes Convert write newlines, carriage returns
+// and tabs as they are instead of escaping them.
+// The result is no longer a valid single-line Go string literal,
+// it's meant for producing human-readable multi-line text.
+func WithLiteralWhitespace() Option {
+	return func(c *Quoter) {
+		c.literalWhitespace = true
+	}
+}
+
+// InvalidUTF8Mode specifies how Convert handles invalid UTF-8.
+type InvalidUTF8Mode int
+
+const (
+	// EscapeHex escapes each invalid byte as \xHH. This is the default.
+	EscapeHex InvalidUTF8Mode = iota
+	// ReplacementChar replaces each run of invalid bytes with a single
+	// Unicode replacement character (U+FFFD), which is then written
+	// like any other rune.
+	ReplacementChar
+	// Drop skips invalid bytes.
+	Drop
+)
+
+// WithInvalidUTF8 sets how Convert handles bytes that are not valid UTF-8.
+// Only EscapeHex preserves the original data.
+func WithInvalidUTF8(mode InvalidUTF8Mode) Option {
+	return func(c *Quoter) {
+		c.invalidUTF8 = mode
+	}
+}
+
+// WithStrictUTF8 makes Convert stop at the first byte that's not valid UTF-8,
+// and return an *InvalidUTF8Error with its offset.
+// The data converted before the invalid byte is still written.
+func WithStrictUTF8() Option {
+	return func(c *Quoter) {
+		c.strictUTF8 = true
+	}
+}
+
+// WithInvalidReplacement makes Convert write repl in place of invalid
+// UTF-8, instead of escaping it or writing a replacement character.
+// Like the replacement character, repl is written once for each invalid
+// byte by default, and once for each run of invalid bytes with
+// ReplacementChar, and Drop still drops invalid bytes. repl is written as
+// it is, even with WithEscaper. It has no effect with WithByteSlice and
+// WithPercentEncoding, which write every byte.
+func WithInvalidReplacement(repl []byte) Option {
+	return func(c *Quoter) {
+		c.invalidReplacement = append([]byte{}, repl...)
+	}
+}
+
+// WithStrictTrailing makes Convert return an error wrapping
+// ErrUnexpectedEOF if the input ends with an incomplete multi-byte rune,
+// as a sign of a truncated stream, instead of escaping its bytes as
+// invalid UTF-8. The data before the incomplete rune is still converted
+// and written. Invalid bytes elsewhere are handled as usual.
+func WithStrictTrailing() Option {
+	return func(c *Quoter) {
+		c.strictTrailing = true
+	}
+}
+
+// WithNulShortForm makes Convert escape NUL as \0 instead of \x00,
+// unless it's followed by an octal digit, which would make \0 ambiguous.
+// This is meant for C-like output, \0 is not valid in Go string literals.
+func WithNulShortForm() Option {
+	return func(c *Quoter) {
+		c.nulShortForm = true
+	}
+}
+
+// WithNormalizeNewlines makes Convert drop the carriage return of each
+// CRLF sequence, so that it's written as \n instead of \r\n.
+// A carriage return that isn't followed by a newline is still escaped.
+func WithNormalizeNewlines() Option {
+	return func(c *Quoter) {
+		c.normalizeNewlines = true
+	}
+}
+
+// WithEscapeSurrogates makes ConvertRunes escape surrogate halves, U+D800
+// to U+DFFF, as themselves, like \ud800, instead of \ufffd, so that runes
+// decoded from invalid UTF-16 are kept. The escape sequences are valid in
+// Python and JavaScript string literals, but not in Go ones. It has no
+// effect on Convert, since surrogate halves are not valid UTF-8.
+func WithEscapeSurrogates() Option {
+	return func(c *Quoter) {
+		c.escapeSurrogates = true
+	}
+}
+
+// WithAutoFlush makes Convert call the Flush method of the writer
+// after writing all of the converted data, if the writer has one,
+// like bufio.Writer.
+func WithAutoFlush() Option {
+	return func(c *Quoter) {
+		c.autoFlush = true
+	}
+}
+
+// WithByteSlice makes Convert write the input as the comma-separated
+// elements of a Go byte slice literal, like "0x61, 0x62,", instead of
+// quoting it. With WithQuotes, the elements are wrapped in "[]byte{"
+// and "}". The input is treated as bytes, so the rune counts in Stats
+// are not updated.
+func WithByteSlice() Option {
+	return func(c *Quoter) {
+		c.byteSlice = true
+	}
+}
+
+// WithColumnTracking makes the converter keep track of the line and
+// column of the output, which can be queried after the conversion
+// with LastPosition.
+func WithColumnTracking() Option {
+	return func(c *Quoter) {
+		c.trackPosition = true
+	}
+}
+
+// WithTemplateSafe makes Convert write a left brace that's followed by
+// another one as {{"{"}}, so that the output can be placed in the text of
+// a text/template template, which writes it as it is, instead of treating
+// the braces as the start of an action. The right
+// delimiter "}}" doesn't need escaping outside of actions.
+func WithTemplateSafe() Option {
+	return func(c *Quoter) {
+		c.templateSafe = true
+	}
+}
+
+// WithHTML makes Convert replace the characters that are special in HTML
+// (<, >, &, ' and ") with HTML entities, so that the output can be placed
+// in HTML text or a quoted attribute value. Other characters are escaped
+// as usual. To recover the original data, unescape the HTML entities
+// first, then the Go escape sequences.
+func WithHTML() Option {
+	return func(c *Quoter) {
+		c.html = true
+	}
+}
+
+// UEscapePrefix selects the letter of the escape sequences
+// of runes that are written as their code point.
+type UEscapePrefix int
+
+const (
+	// GoPrefix uses \u for runes up to U+FFFF and \U for other runes,
+	// like Go. This is the default.
+	GoPrefix UEscapePrefix = iota
+	// LowerPrefix always uses \u.
+	LowerPrefix
+	// UpperPrefix always uses \U.
+	UpperPrefix
+)
+
+// letter returns the letter to use instead of the Go letter l.
+func (p UEscapePrefix) letter(l byte) byte {
+	switch p {
+	case LowerPrefix:
+		return 'u'
+	case UpperPrefix:
+		return 'U'
+	}
+	return l
+}
+
+// WithUEscapePrefix sets the letter used in \u and \U escape sequences.
+// The number of hex digits still depends on the code point: 4 up to
+// U+FFFF, and 8 above. Go requires \u with 4 digits and \U with 8,
+// so anything but GoPrefix produces invalid Go string literals.
+func WithUEscapePrefix(p UEscapePrefix) Option {
+	return func(c *Quoter) {
+		c.style.prefix = p
+	}
+}
+
+// WithUppercaseHex makes Convert use uppercase hex digits in escape
+// sequences, like \xFF and \u00AD. Go accepts both cases.
+func WithUppercaseHex() Option {
+	return func(c *Quoter) {
+		c.style.hex = upperhex
+	}
+}
+
+// WithWriteInterrupt makes Convert stop with ctx.Err() when ctx is done,
+// even if it's blocked writing to a slow writer. Each chunk of converted
+// data is then written from a separate goroutine. If ctx is done during
+// a write, that write may still complete in the background after Convert
+// returns, so the writer should be discarded.
+// Reading is not interrupted, a blocked read still blocks Convert.
+func WithWriteInterrupt(ctx context.Context) Option {
+	return func(c *Quoter) {
+		c.interrupt = ctx
+	}
+}
+
+// WithAlwaysEscape makes Convert backslash runes, like \$, in addition to
+// the delimiter and the backslash, which are always backslashed.
+// It can be used more than once to add more runes.
+// Only printable runes can be backslashed, other runes are ignored,
+// since they are escaped anyway. Note that Go string literals only allow
+// the delimiter and the backslash to be backslashed.
+func WithAlwaysEscape(runes ...rune) Option {
+	return func(c *Quoter) {
+		for _, r := range runes {
+			if isPrint(r, false) {
+				c.alwaysEscape = append(c.alwaysEscape, r)
+			}
+		}
+	}
+}
+
+// WithReplacement makes Convert write repl in place of the valid rune r,
+// instead of escaping it or writing it as it is. repl is written as it is,
+// so it can be anything, like $$ for $ in Makefiles, and an empty repl
+// drops r. It can be used more
+// than once to replace more runes, if r is replaced more than once, the
+// last replacement is used. It takes precedence over the other options
+// that decide how a rune is written, except WithEscaper.
+func WithReplacement(r rune, repl []byte) Option {
+	return func(c *Quoter) {
+		c.replacements = append(c.replacements, replacement{
+			r:    r,
+			repl: append([]byte{}, repl...),
+		})
+	}
+}
+
+// WithHexAlphabet makes Convert use the characters of alphabet as the
+// hex digits in escape sequences, instead of 0-9 and a-f. The alphabet
+// has to consist of 16 distinct printable ASCII characters, and it can't
+// contain the backslash or the delimiter. Otherwise Convert fails with an error wrapping
+// ErrInvalidHexAlphabet. It overrides WithUppercaseHex and vice versa,
+// whichever comes last is used.
+func WithHexAlphabet(alphabet string) Option {
+	return func(c *Quoter) {
+		if err := validateHexAlphabet(alphabet); err != nil {
+			c.setErr(err)
+			return
+		}
+		c.style.hex = alphabet
+	}
+}
+
+// WithShortEscapes overrides the short escape sequences of control
+// characters, like \n and \t. Each control character in escapes is
+// written as its value instead, or if the value is empty, as a hex escape
+// sequence like \x0b, as if it had no short escape. The others keep
+// their default escape sequences. It can be used more than once, later
+// overrides replace earlier ones. If a rune in escapes is not a control
+// character, Convert fails with an error wrapping ErrInvalidShortEscape.
+func WithShortEscapes(escapes map[rune][]byte) Option {
+	return func(c *Quoter) {
+		short := make(map[rune][]byte, len(c.style.short)+len(escapes))
+		for r, e := range c.style.short {
+			short[r] = e
+		}
+		for r, e := range escapes {
+			if !isControl(r) {
+				c.setErr(fmt.Errorf("%w: %U is not a control character", ErrInvalidShortEscape, r))
+				return
+			}
+			short[r] = append([]byte{}, e...)
+		}
+		c.style.short = short
+	}
+}
+
+// validateHexAlphabet checks that alphabet can be used as hex digits.
+func validateHexAlphabet(alphabet string) error {
+	if len(alphabet) != 16 {
+		return fmt.Errorf("%w: %q has %d bytes, not 16", ErrInvalidHexAlphabet, alphabet, len(alphabet))
+	}
+	for i := 0; i < len(alphabet); i++ {
+		b := alphabet[i]
+		if b < ' ' || b >= utf8.RuneSelf || b == 0x7f || b == '\\' {
+			return fmt.Errorf("%w: %q contains %q", ErrInvalidHexAlphabet, alphabet, b)
+		}
+		if strings.IndexByte(alphabet[:i], b) >= 0 {
+			return fmt.Errorf("%w: %q contains %q more than once", ErrInvalidHexAlphabet, alphabet, b)
+		}
+	}
+	return nil
+}
+
+// setErr records err as the error of the options,
+// unless an earlier option already reported one.
+func (c *Quoter) setErr(err error) {
+	if c.optErr == nil {
+		c.optErr = err
+	}
+}
+
+// checkConflicts returns an error if options that
+// contradict each other were used together.
+func (c *Quoter) checkConflicts() error {
+	switch {
+	case c.ascii && c.graphic:
+		return fmt.Errorf("%w: WithASCII and WithGraphic", ErrConflictingOptions)
+	case c.ascii && c.minimal:
+		return fmt.Errorf("%w: WithASCII and WithMinimalEscaping", ErrConflictingOptions)
+	case c.graphic && c.minimal:
+		return fmt.Errorf("%w: WithGraphic and WithMinimalEscaping", ErrConflictingOptions)
+	case c.quotes && c.literalWhitespace:
+		return fmt.Errorf("%w: WithQuotes and WithLiteralWhitespace", ErrConflictingOptions)
+	case c.strictUTF8 && c.invalidUTF8 != EscapeHex:
+		return fmt.Errorf("%w: WithStrictUTF8 and WithInvalidUTF8", ErrConflictingOptions)
+	case c.style.python && c.style.js:
+		return fmt.Errorf("%w: WithPython and WithJavaScript", ErrConflictingOptions)
+	case c.style.csv && (c.style.python || c.style.js):
+		return fmt.Errorf("%w: WithCSV and WithPython or WithJavaScript", ErrConflictingOptions)
+	}
+	return nil
+}
+
+// WithProgress makes Convert call progress after each chunk of data read
+// from the reader is converted, and once more at the end of the conversion,
+// with the number of bytes converted and written so far. The written count
+// includes converted data that's still buffered.
+// A Writer calls progress after each Write, and when it's closed.
+func WithProgress(progress func(readBytes, writtenBytes int)) Option {
+	return func(c *Quoter) {
+		c.progress = progress
+	}
+}
+
+// WithFramedOutput makes Convert write each chunk of converted data
+// preceded by its length, as a 4-byte big-endian integer, for framed
+// protocols. A chunk is written whenever the output buffer is flushed,
+// and empty chunks are not written. The byte counts returned by Convert,
+// Stats and WithMaxOutput don't include the lengths, and neither does
+// the hash of WithHash.
+func WithFramedOutput() Option {
+	return func(c *Quoter) {
+		c.framed = true
+	}
+}
+
+// WithMessageBoundaries makes Convert send each escape sequence, and each
+// run of bytes written as they are, as a message of its own, if the writer
+// is a MessageWriter, for message-oriented transports where every token
+// should be a message, like WebSocket frames. The prefix, the delimiters
+// and the other fixed parts of the output, the continuation of
+// WithLineWrap and the padding of WithFixedWidth are sent as messages of
+// their own too. A run may be split into several messages, where a read
+// or the output buffer ends. This trades efficiency for message
+// granularity: the output isn't buffered, and there's a call for every
+// message. If the writer isn't a MessageWriter, the option has no effect.
+func WithMessageBoundaries() Option {
+	return func(c *Quoter) {
+		c.messages = true
+	}
+}
+
+// WithVersionHeader makes Convert write a small header before everything
+// else, that records the version of the escaping rules and the escaping
+// mode, so that Unconvert can decode the output with the rules it was
+// written with, even if the defaults of the package change. Unconvert
+// decodes Go string literals, with or without WithQuotes, and the output
+// of WithPercentEncoding. With options that make the output something
+// else, or drop or replace parts of the input, conversions fail with an
+// error wrapping ErrConflictingOptions. The header is counted in the
+// number of bytes written. ConvertResume and the items of ConvertJoin
+// after the first don't write it.
+func WithVersionHeader() Option {
+	return func(c *Quoter) {
+		c.versionHeader = true
+	}
+}
+
+// WithFlushAlignment makes Convert write the converted data to the writer
+// in multiples of n bytes, holding back the rest until the next write.
+// Escape sequences may be split between writes. At the end of the
+// conversion, and when a Writer is flushed, the rest is written as is.
+// An n of zero or less means no alignment.
+func WithFlushAlignment(n int) Option {
+	return func(c *Quoter) {
+		c.flushAlign = n
+	}
+}
+
+// WithStripBOM makes Convert drop a UTF-8 byte order mark (U+FEFF) at the
+// start of the input, instead of escaping it as \ufeff. Byte order marks
+// later in the input are escaped as usual. It has no effect with
+// WithByteSlice. The dropped bytes are not counted in Stats.RunesTotal.
+func WithStripBOM() Option {
+	return func(c *Quoter) {
+		c.stripBOM = true
+	}
+}
+
+// WithTrailingNewline makes Convert write a newline after the converted
+// data, and after the closing quote if WithQuotes is used.
+// The newline is included in the returned byte count.
+func WithTrailingNewline() Option {
+	return func(c *Quoter) {
+		c.trailingNewline = true
+	}
+}
+
+// WithPython makes Convert produce the contents of a Python 3 string
+// literal instead of a Go one, using the escape sequences of repr:
+// control characters other than tab, newline and carriage return, and the
+// other non-printable runes up to U+00FF are escaped as \xHH, and the rest
+// as \uHHHH or \UHHHHHHHH. Bytes that are not valid UTF-8 are escaped as
+// the surrogates of PEP 383 (\udc80 to \udcff), which can be turned back
+// into the original bytes in Python with
+// s.encode("utf-8", "surrogateescape"). Which runes are printable is still
+// decided by strconv.IsPrint, which mostly agrees with str.isprintable.
+func WithPython() Option {
+	return func(c *Quoter) {
+		c.style.python = true
+	}
+}
+
+// WithJavaScript makes Convert produce the contents of a JavaScript
+// string literal instead of a Go one. It uses the escape sequences that
+// JavaScript shares with JSON and Go, \xHH for the other control
+// characters, and \uHHHH for the other non-printable runes, with a
+// surrogate pair for those above U+FFFF. The line and paragraph separators
+// U+2028 and U+2029 are always escaped, even with WithGraphic or
+// WithMinimalEscaping, because they end the line in older JavaScript
+// versions. Bytes that are not valid UTF-8 are escaped as \ufffd.
+func WithJavaScript() Option {
+	return func(c *Quoter) {
+		c.style.js = true
+	}
+}
+
+// WithSurrogatePairEscapes makes Convert escape the runes above U+FFFF
+// that are escaped, like all of them with WithASCII, as a UTF-16 surrogate
+// pair of \uHHHH escape sequences, like U+1F600 as \ud83d\ude00, instead of
+// \UHHHHHHHH. That's how JSON and JavaScript spell them, but the output
+// is not a valid Go string literal. WithJavaScript implies it.
+func WithSurrogatePairEscapes() Option {
+	return func(c *Quoter) {
+		c.style.surrogatePairs = true
+	}
+}
+
+// WithCSV makes Convert produce a CSV field as defined by RFC 4180,
+// instead of the contents of a Go string literal: the output is always
+// enclosed in double quotes, because the whole input would have to be
+// read to know whether they're needed, double quotes are doubled, and
+// everything else, including commas, newlines and other control
+// characters, is written as it is. Bytes that are not valid UTF-8 are
+// written as they are too, unless WithInvalidUTF8 or WithStrictUTF8
+// says otherwise. WithDelimiter, WithQuotes and the options that change
+// which runes are escaped have no effect.
+func WithCSV() Option {
+	return func(c *Quoter) {
+		c.style.csv = true
+	}
+}
+
+// WithClassifier makes Convert write the runes for which printable returns
+// true as they are, and escape the others, instead of deciding with
+// strconv.IsPrint, WithASCII, WithGraphic or WithMinimalEscaping.
+// The delimiter, the backslash and the runes added by WithAlwaysEscape are
+// still backslashed, and control characters are always escaped.
+// Rejected printable runes are escaped as \uHHHH or \UHHHHHHHH.
+func WithClassifier(printable func(r rune) bool) Option {
+	return func(c *Quoter) {
+		c.classifier = printable
+	}
+}
+
+// WithEscaper makes Convert use e to convert every rune of the input,
+// instead of the escaping configured by the other options. Invalid UTF-8
+// is still handled according to WithInvalidUTF8 and WithStrictUTF8:
+// e is called with each invalid byte by default, and with the encoding
+// of utf8.RuneError if it's replaced. ConvertRunes passes runes that
+// are not valid code points as utf8.RuneError too.
+func WithEscaper(e Escaper) Option {
+	return func(c *Quoter) {
+		c.escaper = e
+	}
+}
+
+// WithPercentEncoding makes Convert percent-encode the input, as in URLs,
+// instead of producing the contents of a Go string literal. The input is
+// treated as bytes: letters, digits, "-", ".", "_", "~" and the bytes in
+// safe are written as they are, every other byte is written as %XX, with
+// upper case hex digits. For example, with safe "$&+=:@" the output is
+// the same as url.PathEscape's. The rune counts in Stats are not updated,
+// and the options that change escaping and WithQuotes have no effect.
+func WithPercentEncoding(safe string) Option {
+	return func(c *Quoter) {
+		c.percent = true
+		c.percentSafe = safe
+	}
+}
+
+// ByteRange is a range of bytes from First to Last, inclusive.
+type ByteRange struct {
+	First, Last byte
+}
+
+// WithByteRanges makes Convert escape the bytes in ranges as \xHH,
+// and write every other byte as it is, instead of producing the contents
+// of a Go string literal. Like with WithPercentEncoding, the input is
+// treated as bytes, it doesn't have to be UTF-8, the rune counts in Stats
+// are not updated, and the options that change escaping have no effect,
+// except for the hex digits. The backslash and the delimiter are
+// written as they are too, unless they are in one of the ranges.
+func WithByteRanges(ranges []ByteRange) Option {
+	return func(c *Quoter) {
+		c.byteRanges = append([]ByteRange{}, ranges...)
+	}
+}
+
+// WithFullHexEscape makes Convert escape every byte of the input as \xHH,
+// printable or not, for inspecting binary data. It's the same as
+// WithByteRanges with a single range from 0x00 to 0xff, and it overrides
+// WithByteRanges and vice versa, whichever comes last is used.
+func WithFullHexEscape() Option {
+	return func(c *Quoter) {
+		c.byteRanges = []ByteRange{{0x00, 0xff}}
+	}
+}
+
+// WithVerifyGoLiteral makes Convert check that the output, without the
+// quotes added by WithQuotes, is the contents of a double-quoted Go string
+// literal, which strconv.Unquote turns back into the input. If it's not,
+// Convert returns an error wrapping ErrInvalidGoLiteral. The data is
+// still written, the check is done at the end.
+// It's meant for tests and debugging: the whole input and output are
+// kept in memory.
+func WithVerifyGoLiteral() Option {
+	return func(c *Quoter) {
+		c.verify = true
+	}
+}
+
+// WithValidateOutput makes Convert check that the data it writes for the
+// input is valid UTF-8, and return an error wrapping ErrInvalidOutput
+// instead of writing invalid UTF-8. The prefix and suffix are not checked.
+// The escaping modes never write invalid UTF-8, so it's meant to catch
+// bugs, and invalid bytes written on purpose: by WithCSV, WithEscaper,
+// WithInvalidReplacement or WithByteRanges.
+func WithValidateOutput() Option {
+	return func(c *Quoter) {
+		c.validateOutput = true
+	}
+}
+
+// WithHash makes Convert write the converted data to h too,
+// as it's written to the writer, so that h has the hash of the output
+// at the end of the conversion. h is not reset between conversions.
+func WithHash(h hash.Hash) Option {
+	return func(c *Quoter) {
+		c.hash = h
+	}
+}
+
+// WithPrefix makes Convert write prefix before the converted data,
+// and before the opening quote if WithQuotes is used.
+// It's written as it is, without escaping, and counted in the
+// number of bytes written.
+func WithPrefix(prefix []byte) Option {
+	return func(c *Quoter) {
+		c.prefix = append([]byte(nil), prefix...)
+	}
+}
+
+// WithSuffix makes Convert write suffix after the converted data,
+// after the closing quote if WithQuotes is used and the ellipsis of
+// ConvertDisplay, but before the newline added by WithTrailingNewline.
+// It's written as it is, without escaping, and counted in the
+// number of bytes written.
+func WithSuffix(suffix []byte) Option {
+	return func(c *Quoter) {
+		c.suffix = append([]byte(nil), suffix...)
+	}
+}
+
+// WithEllipsis sets the string ConvertDisplay writes after the converted
+// data if it stopped before the end of the input, instead of "...".
+// It's written as it is, without escaping.
+func WithEllipsis(ellipsis string) Option {
+	return func(c *Quoter) {
+		c.ellipsis = []byte(ellipsis)
+	}
+}
@@ -0,0 +1,1974 @@
+package streamquote
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+func TestMaxOutput(t *testing.T) {
+	converter := New(WithMaxOutput(10))
+
+	var buffer bytes.Buffer
+	n, err := converter.Convert(strings.NewReader("ab\x01\x02\x03"), &buffer)
+	if err != ErrOutputTooLarge {
+		t.Fatalf("Expected %v, got %v", ErrOutputTooLarge, err)
+	}
+	expected := `ab\x01\x02`
+	if out := buffer.String(); out != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+	if n != len(expected) {
+		t.Errorf("Expected %d bytes, got %d", len(expected), n)
+	}
+
+	buffer.Reset()
+	n, err = converter.Convert(strings.NewReader("ab\x01\x02"), &buffer)
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if out := buffer.String(); out != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+}
+
+func TestLineWrap(t *testing.T) {
+	in := strings.Repeat("ab\u263a\x01\U0010ffff\xff", 10)
+	continuation := "\" +\n\""
+	converter := New(WithLineWrap(8, continuation))
+
+	var buffer bytes.Buffer
+	n, err := converter.Convert(strings.NewReader(in), &buffer)
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if n != buffer.Len() {
+		t.Errorf("Expected %d bytes, got %d", buffer.Len(), n)
+	}
+
+	lines := strings.Split(buffer.String(), continuation)
+	var unquoted strings.Builder
+	for _, line := range lines {
+		if len(line) > 10 {
+			t.Errorf("Line %q is too long", line)
+		}
+		s, err := strconv.Unquote(`"` + line + `"`)
+		if err != nil {
+			t.Fatalf("Line %q is not a valid string literal: %v", line, err)
+		}
+		unquoted.WriteString(s)
+	}
+	if unquoted.String() != in {
+		t.Errorf("Wrapped output does not round-trip")
+	}
+}
+
+func TestLineWrapDefaultContinuation(t *testing.T) {
+	converter := New(WithLineWrap(4, ""))
+
+	var buffer bytes.Buffer
+	_, err := converter.Convert(strings.NewReader("abcdef\n"), &buffer)
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	expected := "abcd\nef\\n"
+	if out := buffer.String(); out != expected {
+		t.Errorf("Expected %q, got %q", expected, out)
+	}
+}
+
+func TestQuotes(t *testing.T) {
+	converter := New(WithQuotes())
+
+	for _, tt := range quotetests {
+		var buffer bytes.Buffer
+		n, err := converter.Convert(strings.NewReader(tt.in), &buffer)
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if out := buffer.String(); !testEqual(out, tt.out) {
+			t.Errorf("Quote(%s) = %s, want %s", tt.in, out, tt.out)
+		}
+		if n != buffer.Len() {
+			t.Errorf("Quote(%s) returned %d, wrote %d bytes", tt.in, n, buffer.Len())
+		}
+	}
+}
+
+func TestQuotesEmpty(t *testing.T) {
+	tests := []struct {
+		opts     []Option
+		expected string
+	}{
+		{[]Option{WithQuotes()}, `""`},
+		{[]Option{WithQuotes(), WithDelimiter('\'')}, `''`},
+		{[]Option{WithCSV()}, `""`},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		converter := New(tt.opts...)
+		for i := 0; i < 2; i++ {
+			var buffer bytes.Buffer
+			n, err := converter.Convert(strings.NewReader(""), &buffer)
+			if err != nil {
+				t.Fatalf("Converter failed: %v", err)
+			}
+			if buffer.String() != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, buffer.String())
+			}
+			if n != len(tt.expected) {
+				t.Errorf("Expected %d bytes, got %d", len(tt.expected), n)
+			}
+			if n, err := converter.ConvertCount(strings.NewReader("")); n != len(tt.expected) || err != nil {
+				t.Errorf("ConvertCount returned %d, %v, want %d", n, err, len(tt.expected))
+			}
+			// the next round uses the converter after a non-empty conversion
+			converter.Convert(strings.NewReader("abc"), ioutil.Discard)
+		}
+		out, err := converter.ConvertAll(iotest.OneByteReader(strings.NewReader("")))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if string(out) != tt.expected {
+			t.Errorf("Expected %s, got %s", tt.expected, out)
+		}
+	}
+}
+
+func TestLiteralWhitespace(t *testing.T) {
+	converter := New(WithLiteralWhitespace())
+
+	var buffer bytes.Buffer
+	_, err := converter.Convert(strings.NewReader("a\tb\r\nc\"\x00\n"), &buffer)
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	expected := "a\tb\r\nc\\\"\\x00\n"
+	if out := buffer.String(); out != expected {
+		t.Errorf("Expected %q, got %q", expected, out)
+	}
+	if lines := strings.Split(buffer.String(), "\n"); len(lines) != 3 {
+		t.Errorf("Expected 3 lines, got %d", len(lines))
+	}
+}
+
+func TestLiteralWhitespaceIsPrintable(t *testing.T) {
+	converter := New(WithLiteralWhitespace())
+	for _, r := range []rune{'\n', '\r', '\t', 'a', '☺', '"', '\\'} {
+		if !converter.IsPrintable(r) {
+			t.Errorf("IsPrintable(%q) = false, want true", r)
+		}
+	}
+	for _, r := range []rune{0, '\v', 0x7f, 0xad, 0x10ffff} {
+		if converter.IsPrintable(r) {
+			t.Errorf("IsPrintable(%q) = true, want false", r)
+		}
+	}
+}
+
+func TestLiteralWhitespaceLineWrap(t *testing.T) {
+	converter := New(WithLiteralWhitespace(), WithLineWrap(4, ""))
+
+	var buffer bytes.Buffer
+	_, err := converter.Convert(strings.NewReader("abc\ndefgh"), &buffer)
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	expected := "abc\ndefg\nh"
+	if out := buffer.String(); out != expected {
+		t.Errorf("Expected %q, got %q", expected, out)
+	}
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	tests := []struct {
+		mode     InvalidUTF8Mode
+		expected string
+	}{
+		{EscapeHex, `abc\xff\xfedef`},
+		{ReplacementChar, "abc\ufffddef"},
+		{Drop, "abcdef"},
+	}
+
+	for _, tt := range tests {
+		converter := New(WithInvalidUTF8(tt.mode))
+		var buffer bytes.Buffer
+		n, err := converter.Convert(strings.NewReader("abc\xff\xfedef"), &buffer)
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if out := buffer.String(); out != tt.expected {
+			t.Errorf("Mode %d: expected %q, got %q", tt.mode, tt.expected, out)
+		}
+		if n != buffer.Len() {
+			t.Errorf("Mode %d: returned %d, wrote %d bytes", tt.mode, n, buffer.Len())
+		}
+	}
+}
+
+func TestInvalidUTF8ReplacementCharRuns(t *testing.T) {
+	converter := New(WithInvalidUTF8(ReplacementChar))
+
+	var buffer bytes.Buffer
+	_, err := converter.Convert(strings.NewReader("\xffa\xff\xfe\xfdb\xe2\x82"), &buffer)
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	expected := "\ufffda\ufffdb\ufffd"
+	if out := buffer.String(); out != expected {
+		t.Errorf("Expected %q, got %q", expected, out)
+	}
+}
+
+func TestDelimiter(t *testing.T) {
+	converter := New(WithQuotes(), WithDelimiter('\''))
+
+	var buffer bytes.Buffer
+	_, err := converter.Convert(strings.NewReader(`it's "quoted"`), &buffer)
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	expected := `'it\'s "quoted"'`
+	if out := buffer.String(); out != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+}
+
+func TestStrictUTF8(t *testing.T) {
+	converter := New(WithStrictUTF8(), WithQuotes())
+
+	var buffer bytes.Buffer
+	n, err := converter.Convert(strings.NewReader("abc\n\u263a\xffdef"), &buffer)
+	if !errors.Is(err, ErrInvalidUTF8) {
+		t.Fatalf("Expected %v, got %v", ErrInvalidUTF8, err)
+	}
+	var invalidErr *InvalidUTF8Error
+	if !errors.As(err, &invalidErr) {
+		t.Fatalf("Expected an *InvalidUTF8Error, got %T", err)
+	}
+	if invalidErr.Offset != 7 {
+		t.Errorf("Expected offset 7, got %d", invalidErr.Offset)
+	}
+	expected := "\"abc\\n\u263a"
+	if out := buffer.String(); out != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+	if n != buffer.Len() {
+		t.Errorf("Returned %d, wrote %d bytes", n, buffer.Len())
+	}
+
+	buffer.Reset()
+	_, err = converter.Convert(strings.NewReader("abc\u263a"), &buffer)
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+}
+
+func TestNulShortForm(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"\x00", `\0`},
+		{"\x001", `\x001`},
+		{"\x007", `\x007`},
+		{"\x008", `\08`},
+		{"\x00a", `\0a`},
+		{"\x00\x00", `\0\0`},
+		{"\x00\x000", `\0\x000`},
+	}
+
+	converter := New(WithNulShortForm())
+	for _, tt := range tests {
+		for _, r := range []io.Reader{
+			strings.NewReader(tt.in),
+			iotest.OneByteReader(strings.NewReader(tt.in)),
+		} {
+			var buffer bytes.Buffer
+			_, err := converter.Convert(r, &buffer)
+			if err != nil {
+				t.Fatalf("Converter failed: %v", err)
+			}
+			if out := buffer.String(); out != tt.expected {
+				t.Errorf("Convert(%q) = %s, want %s", tt.in, out, tt.expected)
+			}
+		}
+
+		var buffer bytes.Buffer
+		w := NewWriter(&buffer, WithNulShortForm())
+		for i := 0; i < len(tt.in); i++ {
+			w.Write([]byte{tt.in[i]})
+		}
+		w.Close()
+		if out := buffer.String(); out != tt.expected {
+			t.Errorf("Writer(%q) = %s, want %s", tt.in, out, tt.expected)
+		}
+	}
+}
+
+// flushRecorder records whether Flush was called.
+type flushRecorder struct {
+	bytes.Buffer
+	flushed bool
+	err     error
+}
+
+func (f *flushRecorder) Flush() error {
+	f.flushed = true
+	return f.err
+}
+
+func TestAutoFlush(t *testing.T) {
+	var out flushRecorder
+	_, err := New().Convert(strings.NewReader("abc"), &out)
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if out.flushed {
+		t.Errorf("Flush called without WithAutoFlush")
+	}
+
+	converter := New(WithAutoFlush())
+	_, err = converter.Convert(strings.NewReader("abc"), &out)
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if !out.flushed {
+		t.Errorf("Flush not called")
+	}
+
+	out = flushRecorder{err: errors.New("flush failed")}
+	_, err = converter.Convert(strings.NewReader("abc"), &out)
+	if err != out.err {
+		t.Errorf("Expected %v, got %v", out.err, err)
+	}
+	if out.String() != "abc" {
+		t.Errorf("Expected abc, got %s", out.String())
+	}
+}
+
+func TestByteSlice(t *testing.T) {
+	in := []byte("a\x00\xff\n☺")
+	converter := New(WithByteSlice(), WithQuotes(), WithLineWrap(20, ""))
+
+	var buffer bytes.Buffer
+	n, err := converter.Convert(bytes.NewReader(in), &buffer)
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if n != buffer.Len() {
+		t.Errorf("Returned %d, wrote %d bytes", n, buffer.Len())
+	}
+
+	expr, err := parser.ParseExpr(buffer.String())
+	if err != nil {
+		t.Fatalf("Output %s is not a valid expression: %v", buffer.String(), err)
+	}
+	lit, ok := expr.(*ast.CompositeLit)
+	if !ok {
+		t.Fatalf("Output %s is not a composite literal", buffer.String())
+	}
+	var out []byte
+	for _, elt := range lit.Elts {
+		b, err := strconv.ParseUint(elt.(*ast.BasicLit).Value, 0, 8)
+		if err != nil {
+			t.Fatalf("Invalid element: %v", err)
+		}
+		out = append(out, byte(b))
+	}
+	if !bytes.Equal(out, in) {
+		t.Errorf("Expected %v, got %v", in, out)
+	}
+}
+
+func TestByteSliceUnwrapped(t *testing.T) {
+	converter := New(WithByteSlice())
+
+	var buffer bytes.Buffer
+	_, err := converter.Convert(strings.NewReader("ab"), &buffer)
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	expected := "0x61, 0x62,"
+	if out := buffer.String(); out != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+}
+
+func TestColumnTracking(t *testing.T) {
+	tests := []struct {
+		in        string
+		opts      []Option
+		line, col int
+	}{
+		{"", nil, 1, 1},
+		{"abc", nil, 1, 4},
+		{"abc\n", nil, 1, 6},
+		{"abc\ndef", []Option{WithLiteralWhitespace()}, 2, 4},
+		{"abc\n", []Option{WithLiteralWhitespace()}, 2, 1},
+		{"abcdefghij", []Option{WithLineWrap(4, "")}, 3, 3},
+		{"abc\u263adef", []Option{WithLineWrap(4, "\\\n"), WithQuotes()}, 3, 4},
+	}
+
+	for _, tt := range tests {
+		converter := New(append(tt.opts, WithColumnTracking())...)
+		var buffer bytes.Buffer
+		_, err := converter.Convert(strings.NewReader(tt.in), &buffer)
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		line, col := converter.LastPosition()
+		if line != tt.line || col != tt.col {
+			t.Errorf("Convert(%q) = %q: position %d:%d, want %d:%d", tt.in, buffer.String(), line, col, tt.line, tt.col)
+		}
+	}
+
+	if line, col := New().LastPosition(); line != 0 || col != 0 {
+		t.Errorf("Expected no position without tracking, got %d:%d", line, col)
+	}
+}
+
+func TestHTML(t *testing.T) {
+	in := "<a href=\"x\">Tom & Jerry's</a>\n\\\x00☺\xff"
+	converter := New(WithHTML())
+
+	var buffer bytes.Buffer
+	_, err := converter.Convert(strings.NewReader(in), &buffer)
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	out := buffer.String()
+	expected := `&lt;a href=&#34;x&#34;&gt;Tom &amp; Jerry&#39;s&lt;/a&gt;\n\\\x00☺\xff`
+	if out != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+	if strings.ContainsAny(out, "<>\"'") {
+		t.Errorf("Output %s is not safe in an HTML attribute", out)
+	}
+
+	// round trip
+	s := html.UnescapeString(out)
+	var unquoted []byte
+	for len(s) > 0 {
+		r, multibyte, tail, err := strconv.UnquoteChar(s, 0)
+		if err != nil {
+			t.Fatalf("Failed to unquote %s: %v", s, err)
+		}
+		if multibyte {
+			unquoted = append(unquoted, string(r)...)
+		} else {
+			unquoted = append(unquoted, byte(r))
+		}
+		s = tail
+	}
+	if string(unquoted) != in {
+		t.Errorf("Expected %q, got %q", in, unquoted)
+	}
+}
+
+func TestEscapeCase(t *testing.T) {
+	in := "\xff\u00ad\U000fabcd"
+	tests := []struct {
+		opts     []Option
+		expected string
+	}{
+		{nil, `\xff\u00ad\U000fabcd`},
+		{[]Option{WithUEscapePrefix(LowerPrefix)}, `\xff\u00ad\u000fabcd`},
+		{[]Option{WithUEscapePrefix(UpperPrefix)}, `\xff\U00ad\U000fabcd`},
+		{[]Option{WithUppercaseHex()}, `\xFF\u00AD\U000FABCD`},
+		{[]Option{WithUEscapePrefix(LowerPrefix), WithUppercaseHex()}, `\xFF\u00AD\u000FABCD`},
+		{[]Option{WithUEscapePrefix(UpperPrefix), WithUppercaseHex()}, `\xFF\U00AD\U000FABCD`},
+	}
+
+	for _, tt := range tests {
+		out, err := New(tt.opts...).ConvertAll(strings.NewReader(in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if string(out) != tt.expected {
+			t.Errorf("Convert(%q) = %s, want %s", in, out, tt.expected)
+		}
+	}
+}
+
+// blockingWriter blocks every write until release is closed.
+type blockingWriter struct {
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return len(p), nil
+}
+
+func TestWriteInterrupt(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w := &blockingWriter{release: make(chan struct{})}
+	defer close(w.release)
+
+	converter := New(WithWriteInterrupt(ctx))
+	start := time.Now()
+	_, err := converter.Convert(strings.NewReader(generateTestText()), w)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Convert returned after %v", elapsed)
+	}
+
+	// the converter stays usable with a writer that doesn't block
+	var buffer bytes.Buffer
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	converter = New(WithWriteInterrupt(ctx2))
+	if _, err := converter.Convert(strings.NewReader("a\nb"), &buffer); err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if out := buffer.String(); out != `a\nb` {
+		t.Errorf("Expected %s, got %s", `a\nb`, out)
+	}
+}
+
+func TestAlwaysEscape(t *testing.T) {
+	tests := []struct {
+		opts     []Option
+		in       string
+		expected string
+	}{
+		{[]Option{WithAlwaysEscape('$')}, "$x", `\$x`},
+		{[]Option{WithAlwaysEscape('$', '☺')}, "a$☺\"\\\n", `a\$\☺\"\\\n`},
+		{[]Option{WithAlwaysEscape('$'), WithAlwaysEscape('`')}, "$`", "\\$\\`"},
+		{[]Option{WithAlwaysEscape('\n')}, "\n", `\n`},
+		{[]Option{WithAlwaysEscape('$'), WithDelimiter('\'')}, "$'\"", `\$\'"`},
+	}
+
+	for _, tt := range tests {
+		out, err := New(tt.opts...).ConvertAll(strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if string(out) != tt.expected {
+			t.Errorf("Convert(%q) = %s, want %s", tt.in, out, tt.expected)
+		}
+	}
+}
+
+func TestHexAlphabet(t *testing.T) {
+	in := "\x00\x7f\xff\u00ad\U000fabcd"
+	tests := []struct {
+		opts     []Option
+		expected string
+	}{
+		{[]Option{WithHexAlphabet(lowerhex)}, `\x00\x7f\xff\u00ad\U000fabcd`},
+		{[]Option{WithHexAlphabet("fedcba9876543210")}, `\xff\x80\x00\uff52\Ufff05432`},
+		{[]Option{WithUppercaseHex(), WithHexAlphabet("ghijklmnopqrstuv")}, `\xgg\xnv\xvv\uggqt\Ugggvqrst`},
+		{[]Option{WithHexAlphabet("ghijklmnopqrstuv"), WithUppercaseHex()}, `\x00\x7F\xFF\u00AD\U000FABCD`},
+		{[]Option{WithHexAlphabet("0123456789abcdef"), WithByteSlice()}, `0x00, 0x7f, 0xff, 0xc2, 0xad, 0xf3, 0xba, 0xaf, 0x8d,`},
+	}
+	for _, tt := range tests {
+		out, err := New(tt.opts...).ConvertAll(strings.NewReader(in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if string(out) != tt.expected {
+			t.Errorf("Convert(%q) = %s, want %s", in, out, tt.expected)
+		}
+	}
+
+	for _, alphabet := range []string{
+		"",
+		"0123456789abcde",
+		"0123456789abcdefg",
+		"0123456789abcdee",
+		"0123456789abcde\\",
+		"0123456789abcde\n",
+		"0123456789abcd☺",
+		"0123456789\"bcdef",
+	} {
+		var buffer bytes.Buffer
+		_, err := New(WithHexAlphabet(alphabet)).Convert(strings.NewReader(in), &buffer)
+		if !errors.Is(err, ErrInvalidHexAlphabet) {
+			t.Errorf("WithHexAlphabet(%q): expected %v, got %v", alphabet, ErrInvalidHexAlphabet, err)
+		}
+		if buffer.Len() != 0 {
+			t.Errorf("WithHexAlphabet(%q): expected no output, got %s", alphabet, buffer.String())
+		}
+	}
+	_, err := New(WithDelimiter('\''), WithHexAlphabet("0123456789'bcdef")).ConvertAll(strings.NewReader(in))
+	if !errors.Is(err, ErrInvalidHexAlphabet) {
+		t.Errorf("Expected %v, got %v", ErrInvalidHexAlphabet, err)
+	}
+}
+
+func TestASCII(t *testing.T) {
+	for _, tt := range quotetests {
+		out, err := New(WithASCII(), WithQuotes()).ConvertAll(strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if expected := strconv.QuoteToASCII(tt.in); !testEqual(string(out), expected) {
+			t.Errorf("Convert(%q) = %s, want %s", tt.in, out, expected)
+		}
+	}
+}
+
+func TestGraphic(t *testing.T) {
+	for _, in := range []string{"\u00a0\u2000\u3000", "\u00ad\n\x00\xff☺", "a\u2028b"} {
+		out, err := New(WithGraphic(), WithQuotes()).ConvertAll(strings.NewReader(in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if expected := strconv.QuoteToGraphic(in); string(out) != expected {
+			t.Errorf("Convert(%q) = %s, want %s", in, out, expected)
+		}
+	}
+}
+
+func TestMinimalEscaping(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"a\u200db", "a\u200db"},
+		{"\u00ad\u2028\u3000\ufeff\U000e0001\U000fabcd\U0010ffff\u0378", "\u00ad\u2028\u3000\ufeff\U000e0001\U000fabcd\U0010ffff\u0378"},
+		{"\x1b[0m", `\x1b[0m`},
+		{"\x00\t\n\x7f", `\x00\t\n\x7f`},
+		{"\u0080\u0085\u009f\u00a0", "\\u0080\\u0085\\u009f\u00a0"},
+		{"\"\\\xff", `\"\\\xff`},
+	}
+	converter := New(WithMinimalEscaping())
+	for _, tt := range tests {
+		out, err := converter.ConvertAll(strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if string(out) != tt.expected {
+			t.Errorf("Convert(%q) = %q, want %q", tt.in, out, tt.expected)
+		}
+	}
+}
+
+func TestIsPrintableModes(t *testing.T) {
+	tests := []struct {
+		opts    []Option
+		isPrint func(rune) bool
+	}{
+		{nil, strconv.IsPrint},
+		{[]Option{WithASCII()}, func(r rune) bool { return r < utf8.RuneSelf && strconv.IsPrint(r) }},
+		{[]Option{WithGraphic()}, strconv.IsGraphic},
+		{[]Option{WithMinimalEscaping()}, func(r rune) bool { return utf8.ValidRune(r) && (r >= 0xa0 || r >= ' ' && r < 0x7f) }},
+	}
+	runes := []rune{-1, 0, '\t', '\n', ' ', 'a', 0x7f, 0xa0, 0xad, '☺', 0x2028, 0x3000, 0xfffd, 0x1f600, 0xe0001, utf8.MaxRune, utf8.MaxRune + 1}
+	for _, tt := range tests {
+		converter := New(tt.opts...)
+		for _, r := range runes {
+			if got, want := converter.IsPrintable(r), tt.isPrint(r); got != want {
+				t.Errorf("IsPrintable(%U) = %v, want %v", r, got, want)
+			}
+		}
+	}
+}
+
+func TestNewWithOptions(t *testing.T) {
+	conflicting := [][]Option{
+		{WithASCII(), WithGraphic()},
+		{WithASCII(), WithMinimalEscaping()},
+		{WithGraphic(), WithMinimalEscaping()},
+		{WithQuotes(), WithLiteralWhitespace()},
+		{WithStrictUTF8(), WithInvalidUTF8(ReplacementChar)},
+		{WithStrictUTF8(), WithInvalidUTF8(Drop)},
+		{WithPython(), WithJavaScript()},
+		{WithCSV(), WithPython()},
+	}
+	for _, opts := range conflicting {
+		c, err := NewWithOptions(opts...)
+		if !errors.Is(err, ErrConflictingOptions) {
+			t.Errorf("Expected %v, got %v", ErrConflictingOptions, err)
+		}
+		if c != nil {
+			t.Errorf("Expected no converter, got %v", c)
+		}
+	}
+
+	if _, err := NewWithOptions(WithHexAlphabet("0")); !errors.Is(err, ErrInvalidHexAlphabet) {
+		t.Errorf("Expected %v, got %v", ErrInvalidHexAlphabet, err)
+	}
+
+	compatible := [][]Option{
+		nil,
+		{WithASCII(), WithQuotes()},
+		{WithGraphic(), WithQuotes()},
+		{WithMinimalEscaping(), WithLiteralWhitespace()},
+		{WithLiteralWhitespace(), WithASCII()},
+		{WithStrictUTF8(), WithInvalidUTF8(EscapeHex)},
+		{WithInvalidUTF8(Drop), WithQuotes()},
+	}
+	for _, opts := range compatible {
+		c, err := NewWithOptions(opts...)
+		if err != nil {
+			t.Errorf("Expected no error, got %v", err)
+			continue
+		}
+		if _, err := c.ConvertAll(strings.NewReader("a")); err != nil {
+			t.Errorf("Converter failed: %v", err)
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	in := strings.Repeat("a\n", DefaultBufferSize*3/2) + "abcde"
+	type call struct{ read, written int }
+	var calls []call
+	converter := New(WithQuotes(), WithProgress(func(read, written int) {
+		calls = append(calls, call{read, written})
+	}))
+	// bytes.Reader fills the read buffer on every read,
+	// so there are four chunks
+	n, err := converter.Convert(bytes.NewReader([]byte(in)), ioutil.Discard)
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if len(calls) != 5 {
+		t.Fatalf("Expected 5 calls, got %d: %v", len(calls), calls)
+	}
+	for i, c := range calls[:3] {
+		if c.read != (i+1)*DefaultBufferSize {
+			t.Errorf("Call %d: expected %d bytes read, got %d", i, (i+1)*DefaultBufferSize, c.read)
+		}
+	}
+	for i := 1; i < len(calls); i++ {
+		if calls[i].read < calls[i-1].read || calls[i].written < calls[i-1].written {
+			t.Errorf("Counts decreased: %v", calls)
+		}
+	}
+	if last := calls[len(calls)-1]; last.read != len(in) || last.written != n {
+		t.Errorf("Expected final counts %d, %d, got %d, %d", len(in), n, last.read, last.written)
+	}
+}
+
+// recordingWriter records the size of every write.
+type recordingWriter struct {
+	bytes.Buffer
+	sizes []int
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.sizes = append(w.sizes, len(p))
+	return w.Buffer.Write(p)
+}
+
+func TestFramedOutput(t *testing.T) {
+	in, err := ioutil.ReadAll(generateTestString())
+	if err != nil {
+		t.Fatalf("Failed to read large string: %v", err)
+	}
+	for _, opts := range [][]Option{{WithQuotes()}, {WithQuotes(), WithFlushAlignment(1000)}, {WithReadChunkSize(7)}} {
+		expected, err := New(opts...).ConvertAll(bytes.NewReader(in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		var w recordingWriter
+		n, err := New(append(opts, WithFramedOutput())...).Convert(bytes.NewReader(in), &w)
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if n != len(expected) {
+			t.Errorf("Expected %d bytes, got %d", len(expected), n)
+		}
+		var payload []byte
+		frames := w.Bytes()
+		for len(frames) > 0 {
+			if len(frames) < 4 {
+				t.Fatalf("Truncated length prefix: %q", frames)
+			}
+			size := int(binary.BigEndian.Uint32(frames))
+			if size == 0 || size > len(frames)-4 {
+				t.Fatalf("Invalid frame length %d with %d bytes left", size, len(frames)-4)
+			}
+			payload = append(payload, frames[4:4+size]...)
+			frames = frames[4+size:]
+		}
+		if !bytes.Equal(payload, expected) {
+			t.Errorf("Payload doesn't match the unframed output")
+		}
+		if len(w.sizes) < 4 || len(w.sizes)%2 != 0 {
+			t.Errorf("Expected several frames, got writes of %v", w.sizes)
+		}
+	}
+
+	// empty input still produces the quotes
+	var buffer bytes.Buffer
+	if _, err := New(WithFramedOutput(), WithQuotes()).Convert(strings.NewReader(""), &buffer); err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if expected := "\x00\x00\x00\x02\"\""; buffer.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buffer.String())
+	}
+	buffer.Reset()
+	if _, err := New(WithFramedOutput()).Convert(strings.NewReader(""), &buffer); err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if buffer.Len() != 0 {
+		t.Errorf("Expected no frames, got %q", buffer.String())
+	}
+}
+
+// messageRecorder is a MessageWriter that records the messages.
+type messageRecorder struct {
+	messages []string
+}
+
+func (w *messageRecorder) WriteMessage(p []byte) error {
+	w.messages = append(w.messages, string(p))
+	return nil
+}
+
+func (w *messageRecorder) Write(p []byte) (int, error) {
+	return 0, errors.New("Write called instead of WriteMessage")
+}
+
+func TestMessageBoundaries(t *testing.T) {
+	tests := []struct {
+		opts     []Option
+		in       string
+		expected []string
+	}{
+		{nil, "a\nb", []string{"a", `\n`, "b"}},
+		{[]Option{WithQuotes()}, "a\nb", []string{`"`, "a", `\n`, "b", `"`}},
+		{nil, "abc\t\x00☺", []string{"abc", `\t`, `\x00`, "☺"}},
+		{[]Option{WithASCII(), WithPrefix([]byte("s = "))}, "\n\t☺", []string{"s = ", `\n`, `\t`, `\u263a`}},
+		{nil, "", nil},
+	}
+	for _, tt := range tests {
+		var w messageRecorder
+		n, err := New(append(tt.opts, WithMessageBoundaries())...).Convert(strings.NewReader(tt.in), &w)
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if !reflect.DeepEqual(w.messages, tt.expected) {
+			t.Errorf("Convert(%q) sent %q, want %q", tt.in, w.messages, tt.expected)
+		}
+		if expected := len(strings.Join(tt.expected, "")); n != expected {
+			t.Errorf("Convert(%q) = %d, want %d", tt.in, n, expected)
+		}
+	}
+
+	// other writers get the same output as without the option
+	for _, tt := range tests {
+		expected, err := New(tt.opts...).ConvertAll(strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		out, err := New(append(tt.opts, WithMessageBoundaries())...).ConvertAll(strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if !bytes.Equal(out, expected) {
+			t.Errorf("Convert(%q) = %q, want %q", tt.in, out, expected)
+		}
+	}
+}
+
+func TestFlushAlignment(t *testing.T) {
+	in, err := ioutil.ReadAll(generateTestString())
+	if err != nil {
+		t.Fatalf("Failed to read large string: %v", err)
+	}
+	expected, err := New(WithQuotes()).ConvertAll(bytes.NewReader(in))
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+
+	for _, align := range []int{1, 1000, 4096, 100000} {
+		var w recordingWriter
+		_, err := New(WithQuotes(), WithFlushAlignment(align)).Convert(bytes.NewReader(in), &w)
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if !bytes.Equal(w.Bytes(), expected) {
+			t.Errorf("Alignment %d: output doesn't match", align)
+		}
+		if len(w.sizes) < 2 {
+			t.Errorf("Alignment %d: expected several writes, got %v", align, w.sizes)
+		}
+		for i, size := range w.sizes[:len(w.sizes)-1] {
+			if size%align != 0 {
+				t.Errorf("Alignment %d: write %d has %d bytes", align, i, size)
+			}
+		}
+	}
+
+	// the flushes after each read are aligned too
+	var w recordingWriter
+	_, err = New(WithQuotes(), WithFlushAlignment(8), WithReadChunkSize(5)).Convert(bytes.NewReader(in[:1000]), &w)
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if expected, _ := New(WithQuotes()).ConvertAll(bytes.NewReader(in[:1000])); !bytes.Equal(w.Bytes(), expected) {
+		t.Errorf("Output with read chunks doesn't match")
+	}
+	if len(w.sizes) < 2 {
+		t.Errorf("Expected several writes, got %v", w.sizes)
+	}
+	for i, size := range w.sizes[:len(w.sizes)-1] {
+		if size%8 != 0 {
+			t.Errorf("With read chunks: write %d has %d bytes", i, size)
+		}
+	}
+}
+
+func TestStripBOM(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"\ufeffabc", `abc`},
+		{"\ufeff", ``},
+		{"\ufeff\ufeffa", `\ufeffa`},
+		{"a\ufeff", `a\ufeff`},
+		{"\xef\xbb", `\xef\xbb`},
+		{"\xef\xbba", `\xef\xbba`},
+		{"", ``},
+	}
+
+	converter := New(WithStripBOM())
+	for _, tt := range tests {
+		for _, r := range []io.Reader{
+			strings.NewReader(tt.in),
+			iotest.OneByteReader(strings.NewReader(tt.in)),
+		} {
+			var buffer bytes.Buffer
+			_, err := converter.Convert(r, &buffer)
+			if err != nil {
+				t.Fatalf("Converter failed: %v", err)
+			}
+			if out := buffer.String(); out != tt.expected {
+				t.Errorf("Convert(%q) = %s, want %s", tt.in, out, tt.expected)
+			}
+		}
+
+		var buffer bytes.Buffer
+		w := NewWriter(&buffer, WithStripBOM())
+		for i := 0; i < len(tt.in); i++ {
+			w.Write([]byte{tt.in[i]})
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		if out := buffer.String(); out != tt.expected {
+			t.Errorf("Writer: Write(%q) = %s, want %s", tt.in, out, tt.expected)
+		}
+	}
+}
+
+func TestTrailingNewline(t *testing.T) {
+	tests := []struct {
+		opts     []Option
+		in       string
+		expected string
+	}{
+		{nil, "a\nb", "a\\nb\n"},
+		{nil, "", "\n"},
+		{[]Option{WithQuotes()}, "a\nb", "\"a\\nb\"\n"},
+		{[]Option{WithQuotes()}, "", "\"\"\n"},
+		{[]Option{WithQuotes(), WithByteSlice()}, "a", "[]byte{0x61,}\n"},
+		{[]Option{WithQuotes(), WithLineWrap(4, "")}, "abcdef", "\"abc\ndef\"\n"},
+	}
+	for _, tt := range tests {
+		converter := New(append(tt.opts, WithTrailingNewline())...)
+		var buffer bytes.Buffer
+		n, err := converter.Convert(strings.NewReader(tt.in), &buffer)
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if out := buffer.String(); out != tt.expected {
+			t.Errorf("Convert(%q) = %q, want %q", tt.in, out, tt.expected)
+		}
+		if n != buffer.Len() {
+			t.Errorf("Convert(%q) returned %d, wrote %d bytes", tt.in, n, buffer.Len())
+		}
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	in := generateTestText()
+	expected := strconv.Quote(in)
+	for _, size := range []int{utf8.UTFMax, 100, DefaultBufferSize * 2} {
+		c := New(WithQuotes(), WithBufferSize(size))
+		out, err := c.ConvertAll(strings.NewReader(in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if string(out) != expected {
+			t.Errorf("Buffer size %d: output does not match", size)
+		}
+		if l := len(c.readBuffer); l != size {
+			t.Errorf("Expected buffer of %d bytes, got %d", size, l)
+		}
+	}
+
+	for _, size := range []int{-1, 0, utf8.UTFMax - 1} {
+		_, err := New(WithBufferSize(size)).ConvertAll(strings.NewReader(in))
+		if !errors.Is(err, ErrBufferTooSmall) {
+			t.Errorf("Buffer size %d: expected %v, got %v", size, ErrBufferTooSmall, err)
+		}
+	}
+}
+
+// unquotePython unescapes the contents of a Python 3 string literal,
+// turning the surrogates of PEP 383 back into bytes.
+func unquotePython(s string) (string, error) {
+	var b []byte
+	for len(s) > 0 {
+		if s[0] != '\\' {
+			b = append(b, s[0])
+			s = s[1:]
+			continue
+		}
+		if len(s) < 2 {
+			return "", errors.New("trailing backslash")
+		}
+		digits := 0
+		switch s[1] {
+		case 'x':
+			digits = 2
+		case 'u':
+			digits = 4
+		case 'U':
+			digits = 8
+		case 'n':
+			b = append(b, '\n')
+		case 'r':
+			b = append(b, '\r')
+		case 't':
+			b = append(b, '\t')
+		case '\\', '\'', '"':
+			b = append(b, s[1])
+		default:
+			return "", fmt.Errorf("unexpected escape sequence %q", s[:2])
+		}
+		if digits == 0 {
+			s = s[2:]
+			continue
+		}
+		if len(s) < 2+digits {
+			return "", fmt.Errorf("short escape sequence %q", s)
+		}
+		v, err := strconv.ParseUint(s[2:2+digits], 16, 32)
+		if err != nil {
+			return "", err
+		}
+		if v >= 0xdc80 && v <= 0xdcff {
+			b = append(b, byte(v-0xdc00))
+		} else {
+			b = appendRune(b, rune(v))
+		}
+		s = s[2+digits:]
+	}
+	return string(b), nil
+}
+
+func TestPython(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		// expected outputs from repr in Python 3
+		{"a\a\b\f\v\x00\x7f", `a\x07\x08\x0c\x0b\x00\x7f`},
+		{"\n\t\r\"\\", `\n\t\r\"\\`},
+		{"\u0080\u00ad\u00e9", `\x80\xad` + "\u00e9"},
+		{"\u2028\U000fabcd\U0001f600☺", `\u2028\U000fabcd` + "\U0001f600☺"},
+		{"\xffa\xe2\x98", `\udcffa\udce2\udc98`},
+	}
+	converter := New(WithPython())
+	for _, tt := range tests {
+		out, err := converter.ConvertAll(strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if string(out) != tt.expected {
+			t.Errorf("Convert(%q) = %s, want %s", tt.in, out, tt.expected)
+		}
+	}
+
+	out, err := New(WithPython(), WithUppercaseHex()).ConvertAll(strings.NewReader("\xff\u00ad"))
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if expected := `\uDCFF\xAD`; string(out) != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+
+	in, err := ioutil.ReadAll(generateTestString())
+	if err != nil {
+		t.Fatalf("Failed to read large string: %v", err)
+	}
+	out, err = converter.ConvertAll(bytes.NewReader(in))
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	unquoted, err := unquotePython(string(out))
+	if err != nil {
+		t.Fatalf("unquotePython failed: %v", err)
+	}
+	if unquoted != string(in) {
+		t.Errorf("Round trip failed")
+	}
+}
+
+func TestVerifyGoLiteral(t *testing.T) {
+	in, err := ioutil.ReadAll(io.LimitReader(generateLargeString(), 256*1024))
+	if err != nil {
+		t.Fatalf("Failed to read large string: %v", err)
+	}
+	for _, opts := range [][]Option{nil, {WithQuotes()}, {WithASCII()}, {WithUppercaseHex(), WithQuotes()}} {
+		converter := New(append(opts, WithVerifyGoLiteral())...)
+		if _, err := converter.ConvertAll(bytes.NewReader(in)); err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+		if _, err := converter.ConvertRunes([]rune("a\n☺\x00"), ioutil.Discard); err != nil {
+			t.Errorf("ConvertRunes: expected no error, got %v", err)
+		}
+		// an invalid rune is written as U+FFFD, which is what it encodes to
+		if _, err := converter.ConvertRunes([]rune{'a', -1, 'b'}, ioutil.Discard); err != nil {
+			t.Errorf("ConvertRunes with an invalid rune: expected no error, got %v", err)
+		}
+	}
+
+	tests := []struct {
+		opts []Option
+		in   string
+	}{
+		{[]Option{WithLiteralWhitespace()}, "a\nb"},
+		{[]Option{WithLiteralWhitespace(), WithQuotes()}, "a\r\nb"},
+		{[]Option{WithInvalidUTF8(Drop)}, "a\xffb"},
+		{[]Option{WithDelimiter('\'')}, "'"},
+		{[]Option{WithPython()}, "\xff"},
+		{[]Option{WithUEscapePrefix(UpperPrefix)}, "\u00ad"},
+		{[]Option{WithStripBOM()}, "\ufeffabc"},
+		{[]Option{WithNormalizeNewlines()}, "a\r\nb"},
+	}
+	for _, tt := range tests {
+		converter := New(append(tt.opts, WithVerifyGoLiteral())...)
+		if _, err := converter.ConvertAll(strings.NewReader(tt.in)); !errors.Is(err, ErrInvalidGoLiteral) {
+			t.Errorf("Convert(%q): expected %v, got %v", tt.in, ErrInvalidGoLiteral, err)
+		}
+		// []rune turns invalid bytes into U+FFFD, which is written correctly
+		if utf8.ValidString(tt.in) {
+			if _, err := converter.ConvertRunes([]rune(tt.in), ioutil.Discard); !errors.Is(err, ErrInvalidGoLiteral) {
+				t.Errorf("ConvertRunes(%q): expected %v, got %v", tt.in, ErrInvalidGoLiteral, err)
+			}
+		}
+		// the converter can be reused
+		if _, err := converter.ConvertAll(strings.NewReader("abc")); err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	in := generateTestText()
+	expected := sha256.Sum256([]byte(strconv.Quote(in)))
+
+	h := sha256.New()
+	converter := New(WithQuotes(), WithHash(h))
+	var buffer bytes.Buffer
+	if _, err := converter.Convert(strings.NewReader(in), &buffer); err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if sum := h.Sum(nil); !bytes.Equal(sum, expected[:]) {
+		t.Errorf("Expected hash %x, got %x", expected, sum)
+	}
+
+	// only the data accepted by the writer is hashed
+	h.Reset()
+	w := &failingWriter{limit: 10, err: errTest}
+	converter.Convert(strings.NewReader(in), w)
+	if sum, expected := h.Sum(nil), sha256.Sum256([]byte(strconv.Quote(in)[:10])); !bytes.Equal(sum, expected[:]) {
+		t.Errorf("Expected hash %x, got %x", expected, sum)
+	}
+}
+
+func TestJavaScript(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"a\a\b\f\v\x00\x7f", `a\x07\b\f\v\x00\x7f`},
+		{"\n\t\r\"\\", `\n\t\r\"\\`},
+		{"\u0080\u00e9", `\u0080` + "\u00e9"},
+		{"a\u2028b\u2029c", `a\u2028b\u2029c`},
+		{"\U000fabcd\U0001f600", `\udbaa\udfcd` + "\U0001f600"},
+		{"\xffa", `\ufffda`},
+	}
+	for _, opts := range [][]Option{
+		{WithJavaScript()},
+		{WithJavaScript(), WithGraphic()},
+	} {
+		converter := New(opts...)
+		for _, tt := range tests {
+			out, err := converter.ConvertAll(strings.NewReader(tt.in))
+			if err != nil {
+				t.Fatalf("Converter failed: %v", err)
+			}
+			if string(out) != tt.expected {
+				t.Errorf("Convert(%q) = %s, want %s", tt.in, out, tt.expected)
+			}
+		}
+	}
+
+	// the separators aren't control characters, so only JavaScript mode
+	// escapes them with minimal escaping
+	in := "a\u2028b\u2029c"
+	out, err := New(WithMinimalEscaping()).ConvertAll(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if string(out) != in {
+		t.Errorf("Expected %q, got %q", in, out)
+	}
+	out, err = New(WithJavaScript(), WithMinimalEscaping()).ConvertAll(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if expected := `a\u2028b\u2029c`; string(out) != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+	if New(WithJavaScript()).IsPrintable('\u2029') {
+		t.Errorf("Expected U+2029 not to be printable in JavaScript mode")
+	}
+}
+
+func TestCSV(t *testing.T) {
+	fields := []string{
+		`a,b`,
+		`say "hi"`,
+		"line\nbreak",
+		`"`,
+		"\u263a, \x00\\\t",
+		strings.Repeat(`ab"c,`, 10000),
+	}
+	converter := New(WithCSV())
+	for _, field := range fields {
+		var expected bytes.Buffer
+		w := csv.NewWriter(&expected)
+		w.Write([]string{field})
+		w.Flush()
+
+		out, err := converter.ConvertAll(strings.NewReader(field))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		// all of these fields have to be quoted, so the output should match
+		if string(out)+"\n" != expected.String() {
+			t.Errorf("Convert(%.20q) = %.20q, want %.20q", field, out, expected.String())
+		}
+		record, err := csv.NewReader(bytes.NewReader(out)).Read()
+		if err != nil {
+			t.Fatalf("Failed to read CSV: %v", err)
+		}
+		if len(record) != 1 || record[0] != field {
+			t.Errorf("Read back %.20q, want %.20q", record, field)
+		}
+	}
+
+	// fields that don't need quotes are quoted anyway
+	out, err := New(WithCSV(), WithDelimiter('\'')).ConvertAll(strings.NewReader("abc"))
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if expected := `"abc"`; string(out) != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+
+	out, err = converter.ConvertAll(strings.NewReader("a\xff\"\xe2\x98"))
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if expected := "\"a\xff\"\"\xe2\x98\""; string(out) != expected {
+		t.Errorf("Expected %q, got %q", expected, out)
+	}
+	out, err = New(WithCSV(), WithInvalidUTF8(ReplacementChar)).ConvertAll(strings.NewReader("a\xff\xfe"))
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if expected := "\"a\ufffd\""; string(out) != expected {
+		t.Errorf("Expected %q, got %q", expected, out)
+	}
+}
+
+// upperEscaper writes letters in upper case, and drops everything else.
+type upperEscaper struct{}
+
+func (upperEscaper) Escape(dst []byte, r rune, raw []byte) []byte {
+	if unicode.IsLetter(r) {
+		return appendRune(dst, unicode.ToUpper(r))
+	}
+	return dst
+}
+
+func TestEscaper(t *testing.T) {
+	in, err := ioutil.ReadAll(generateTestString())
+	if err != nil {
+		t.Fatalf("Failed to read large string: %v", err)
+	}
+	inputs := [][]byte{in}
+	for _, tt := range quotetests {
+		inputs = append(inputs, []byte(tt.in))
+	}
+	withEscaper := New(WithEscaper(DefaultEscaper))
+	for _, in := range inputs {
+		var want, got bytes.Buffer
+		expected, err := New().ConvertStats(bytes.NewReader(in), &want)
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		stats, err := withEscaper.ConvertStats(bytes.NewReader(in), &got)
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Errorf("Output of DefaultEscaper does not match for %.20q", in)
+		}
+		if stats != expected {
+			t.Errorf("Expected %+v, got %+v", expected, stats)
+		}
+	}
+
+	out, err := New(WithEscaper(upperEscaper{}), WithQuotes()).ConvertAll(strings.NewReader("a-b \u00e9\xff"))
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if expected := "\"AB\u00c9\""; string(out) != expected {
+		t.Errorf("Expected %q, got %q", expected, out)
+	}
+}
+
+func TestPrefixSuffix(t *testing.T) {
+	tests := []struct {
+		opts     []Option
+		in       string
+		expected string
+	}{
+		{nil, "a\nb", "value = a\\nb;"},
+		{nil, "", "value = ;"},
+		{[]Option{WithQuotes()}, "a\nb", "value = \"a\\nb\";"},
+		{[]Option{WithQuotes(), WithTrailingNewline()}, "a", "value = \"a\";\n"},
+		{[]Option{WithQuotes(), WithVerifyGoLiteral()}, "a\xff", "value = \"a\\xff\";"},
+	}
+	for _, tt := range tests {
+		opts := append(tt.opts, WithPrefix([]byte("value = ")), WithSuffix([]byte(";")))
+		var buffer bytes.Buffer
+		n, err := New(opts...).Convert(strings.NewReader(tt.in), &buffer)
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if out := buffer.String(); out != tt.expected {
+			t.Errorf("Convert(%q) = %q, want %q", tt.in, out, tt.expected)
+		}
+		if n != buffer.Len() {
+			t.Errorf("Convert(%q) returned %d, wrote %d bytes", tt.in, n, buffer.Len())
+		}
+	}
+
+	var buffer bytes.Buffer
+	converter := New(WithQuotes(), WithPrefix([]byte("<")), WithSuffix([]byte(">")))
+	converter.ConvertDisplay(strings.NewReader("abcdef"), &buffer, 3)
+	if expected := `<"abc"...>`; buffer.String() != expected {
+		t.Errorf("Expected %s, got %s", expected, buffer.String())
+	}
+}
+
+func TestReplacement(t *testing.T) {
+	tests := []struct {
+		opts     []Option
+		in       string
+		expected string
+	}{
+		{nil, "$(HOME)", "$$(HOME)"},
+		{nil, "a\tb \"$\u263a\"", `a\tb \"$$` + "\u263a" + `\"`},
+		{[]Option{WithReplacement('$', []byte("$$$$"))}, "$a", "$$$$a"},
+		{[]Option{WithReplacement('\u263a', []byte(":)"))}, "\u263a$", ":)$$"},
+		{[]Option{WithReplacement('\n', nil)}, "a\nb", "ab"},
+		{[]Option{WithReplacement('"', []byte(`""`))}, `say "hi"`, `say ""hi""`},
+	}
+	for _, tt := range tests {
+		converter := New(append([]Option{WithReplacement('$', []byte("$$"))}, tt.opts...)...)
+		out, err := converter.ConvertAll(strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if string(out) != tt.expected {
+			t.Errorf("Convert(%q) = %s, want %s", tt.in, out, tt.expected)
+		}
+	}
+}
+
+func TestNormalizeNewlines(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"a\r\nb", `a\nb`},
+		{"a\rb", `a\rb`},
+		{"a\r", `a\r`},
+		{"\r\r\n\n\r", `\r\n\n\r`},
+	}
+	converter := New(WithNormalizeNewlines())
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		_, err := converter.Convert(iotest.OneByteReader(strings.NewReader(tt.in)), &buffer)
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if out := buffer.String(); out != tt.expected {
+			t.Errorf("Convert(%q) = %s, want %s", tt.in, out, tt.expected)
+		}
+
+		buffer.Reset()
+		w := NewWriter(&buffer, WithNormalizeNewlines())
+		for i := 0; i < len(tt.in); i++ {
+			w.Write([]byte{tt.in[i]})
+		}
+		w.Close()
+		if out := buffer.String(); out != tt.expected {
+			t.Errorf("Writer(%q) = %s, want %s", tt.in, out, tt.expected)
+		}
+
+		buffer.Reset()
+		converter.ConvertRunes([]rune(tt.in), &buffer)
+		if out := buffer.String(); out != tt.expected {
+			t.Errorf("ConvertRunes(%q) = %s, want %s", tt.in, out, tt.expected)
+		}
+	}
+}
+
+func TestShortEscapes(t *testing.T) {
+	in := "\a\b\f\n\r\t\v\x1b\u0085"
+	tests := []struct {
+		escapes  map[rune][]byte
+		expected string
+	}{
+		{nil, `\a\b\f\n\r\t\v\x1b\u0085`},
+		{map[rune][]byte{'\v': nil}, `\a\b\f\n\r\t\x0b\x1b\u0085`},
+		{map[rune][]byte{'\x1b': []byte(`\e`), '\n': []byte(`\N`)}, `\a\b\f\N\r\t\v\e\u0085`},
+		{map[rune][]byte{'\u0085': []byte(`\N`), '\a': {}}, `\x07\b\f\n\r\t\v\x1b\N`},
+	}
+	for _, tt := range tests {
+		out, err := New(WithShortEscapes(tt.escapes)).ConvertAll(strings.NewReader(in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if string(out) != tt.expected {
+			t.Errorf("Convert with %q = %s, want %s", tt.escapes, out, tt.expected)
+		}
+	}
+
+	converter := New(WithShortEscapes(map[rune][]byte{'\t': nil}), WithShortEscapes(map[rune][]byte{'\v': nil}))
+	out, err := converter.ConvertAll(strings.NewReader("\t\v\n"))
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if expected := `\x09\x0b\n`; string(out) != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+
+	for _, r := range []rune{'a', ' ', '\u00a0', 0x110000} {
+		_, err := NewWithOptions(WithShortEscapes(map[rune][]byte{r: []byte("x")}))
+		if !errors.Is(err, ErrInvalidShortEscape) {
+			t.Errorf("Expected %v for %U, got %v", ErrInvalidShortEscape, r, err)
+		}
+	}
+}
+
+func TestPercentEncoding(t *testing.T) {
+	var all []byte
+	for b := 0; b < 256; b++ {
+		all = append(all, byte(b))
+	}
+	inputs := []string{
+		string(all),
+		"a b/c?d=e&f#g",
+		"\u263a\x00\xff\U0001f600",
+		"",
+	}
+	converter := New(WithPercentEncoding("$&+=:@"), WithQuotes())
+	for _, in := range inputs {
+		out, err := converter.ConvertAll(strings.NewReader(in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if expected := url.PathEscape(in); string(out) != expected {
+			t.Errorf("Convert(%q) = %s, want %s", in, out, expected)
+		}
+		unescaped, err := url.PathUnescape(string(out))
+		if err != nil || unescaped != in {
+			t.Errorf("PathUnescape(%s) = %q, %v, want %q", out, unescaped, err, in)
+		}
+	}
+
+	out, err := New(WithPercentEncoding("")).ConvertAll(strings.NewReader("a/b c"))
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if expected := "a%2Fb%20c"; string(out) != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+	var buffer bytes.Buffer
+	New(WithPercentEncoding("/")).ConvertRunes([]rune("/\u00e9 "), &buffer)
+	if expected := "/%C3%A9%20"; buffer.String() != expected {
+		t.Errorf("Expected %s, got %s", expected, buffer.String())
+	}
+}
+
+// watchingReader returns one line per Read, and records how much
+// output there was before each Read.
+type watchingReader struct {
+	lines []string
+	out   *bytes.Buffer
+	seen  []int
+}
+
+func (w *watchingReader) Read(p []byte) (int, error) {
+	w.seen = append(w.seen, w.out.Len())
+	if len(w.lines) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, w.lines[0])
+	w.lines[0] = w.lines[0][n:]
+	if w.lines[0] == "" {
+		w.lines = w.lines[1:]
+	}
+	return n, nil
+}
+
+func TestReadChunkSize(t *testing.T) {
+	lines := []string{"first\n", "second \u263a\n", "third\n"}
+	var buffer bytes.Buffer
+	r := &watchingReader{lines: append([]string(nil), lines...), out: &buffer}
+	converter := New(WithReadChunkSize(4))
+	if _, err := converter.Convert(r, &buffer); err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if expected := strings.Join(lines, ""); buffer.String() != strings.Trim(strconv.Quote(expected), `"`) {
+		t.Errorf("Output does not match: %s", buffer.String())
+	}
+	// the output of each chunk is written before the next one is read
+	for i := 1; i < len(r.seen); i++ {
+		if r.seen[i] <= r.seen[i-1] && i < len(r.seen)-1 {
+			t.Errorf("No output between reads %d and %d: %v", i-1, i, r.seen)
+		}
+	}
+	if len(r.seen) < 7 {
+		t.Errorf("Expected reads of at most 4 bytes, got %d reads", len(r.seen))
+	}
+
+	// by default, the output is buffered until the end
+	buffer.Reset()
+	r = &watchingReader{lines: append([]string(nil), lines...), out: &buffer}
+	New().Convert(r, &buffer)
+	if last := r.seen[len(r.seen)-1]; last != 0 {
+		t.Errorf("Expected no output before the end, got %d bytes", last)
+	}
+
+	if _, err := NewWithOptions(WithReadChunkSize(0)); !errors.Is(err, ErrBufferTooSmall) {
+		t.Errorf("Expected %v, got %v", ErrBufferTooSmall, err)
+	}
+}
+
+func TestClassifier(t *testing.T) {
+	letters := func(r rune) bool {
+		return r < utf8.RuneSelf && unicode.IsLetter(r)
+	}
+	all := func(r rune) bool {
+		return true
+	}
+	tests := []struct {
+		opts     []Option
+		in       string
+		expected string
+	}{
+		{[]Option{WithClassifier(letters)}, "ab1 \"\\\néz\xff", `ab\u0031\u0020\"\\\n\u00e9z\xff`},
+		{[]Option{WithClassifier(letters), WithPython()}, "a1é\U0001f600", `a\x31\xe9\U0001f600`},
+		{[]Option{WithClassifier(all)}, "a\"\\\n  ", "a\\\"\\\\\\n  "},
+		{[]Option{WithClassifier(all), WithAlwaysEscape('a')}, "abc", `\abc`},
+		{[]Option{WithClassifier(letters), WithQuotes()}, "x y", `"x\u0020y"`},
+	}
+	for _, tt := range tests {
+		out, err := New(tt.opts...).ConvertAll(strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if string(out) != tt.expected {
+			t.Errorf("Convert(%q) = %s, want %s", tt.in, out, tt.expected)
+		}
+	}
+}
+
+func TestInvalidReplacement(t *testing.T) {
+	tests := []struct {
+		opts     []Option
+		in       string
+		expected string
+	}{
+		{[]Option{WithInvalidReplacement([]byte("?"))}, "a\xffb", "a?b"},
+		{[]Option{WithInvalidReplacement([]byte("<?>"))}, "a\xff\xfeb\xe2\x98", "a<?><?>b<?><?>"},
+		{[]Option{WithInvalidReplacement([]byte("<?>")), WithInvalidUTF8(ReplacementChar)}, "a\xff\xfeb\xe2\x98", "a<?>b<?>"},
+		{[]Option{WithInvalidReplacement([]byte("?")), WithInvalidUTF8(Drop)}, "a\xffb", "ab"},
+		{[]Option{WithInvalidReplacement(nil)}, "a\xff\"b", `a\"b`},
+		{[]Option{WithInvalidReplacement([]byte("?")), WithQuotes(), WithPython()}, "\xff☺", `"?☺"`},
+		{[]Option{WithInvalidReplacement([]byte("?")), WithEscaper(upperEscaper{})}, "a\xffb", "A?B"},
+	}
+	for _, tt := range tests {
+		converter := New(tt.opts...)
+		out, err := converter.ConvertAll(strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if string(out) != tt.expected {
+			t.Errorf("Convert(%q) = %s, want %s", tt.in, out, tt.expected)
+		}
+		if factor := converter.MaxExpansionFactor(); factor > 0 && len(out) > factor*len(tt.in) {
+			t.Errorf("Convert(%q) wrote %d bytes, more than %d times the input", tt.in, len(out), factor)
+		}
+	}
+
+	var buffer bytes.Buffer
+	converter := New(WithInvalidReplacement([]byte("?")))
+	if _, err := converter.ConvertRunes([]rune{'a', 0xd800, 'b', 0x110000}, &buffer); err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if expected := "a?b?"; buffer.String() != expected {
+		t.Errorf("Expected %s, got %s", expected, buffer.String())
+	}
+}
+
+func TestByteRanges(t *testing.T) {
+	controls := []ByteRange{{0x00, 0x1f}, {0x7f, 0x7f}}
+	in := "PK\x03\x04\x14\x00\xff\xfe\x7f\x80\"\\☺\n"
+	tests := []struct {
+		opts     []Option
+		in       string
+		expected string
+	}{
+		{[]Option{WithByteRanges(controls)}, in, "PK\\x03\\x04\\x14\\x00\xff\xfe\\x7f\x80\"\\☺\\x0a"},
+		{[]Option{WithByteRanges(controls), WithUppercaseHex()}, "\x1f\x1e", `\x1F\x1E`},
+		{[]Option{WithByteRanges(append(controls, ByteRange{0x80, 0xff}, ByteRange{'\\', '\\'}))}, in, `PK\x03\x04\x14\x00\xff\xfe\x7f\x80"\x5c\xe2\x98\xba\x0a`},
+		{[]Option{WithByteRanges(nil), WithQuotes()}, in, `"` + in + `"`},
+		{[]Option{WithByteRanges([]ByteRange{{0, 0xff}})}, "ab", `\x61\x62`},
+	}
+	for _, tt := range tests {
+		converter := New(tt.opts...)
+		out, err := converter.ConvertAll(strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if string(out) != tt.expected {
+			t.Errorf("Convert(%q) = %q, want %q", tt.in, out, tt.expected)
+		}
+		if factor := converter.MaxExpansionFactor(); len(out) > factor*len(tt.in)+2 {
+			t.Errorf("Convert(%q) wrote %d bytes, more than %d times the input", tt.in, len(out), factor)
+		}
+	}
+
+	var buffer bytes.Buffer
+	if _, err := New(WithByteRanges(controls)).ConvertRunes([]rune("a\x00☺"), &buffer); err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if expected := `a\x00☺`; buffer.String() != expected {
+		t.Errorf("Expected %s, got %s", expected, buffer.String())
+	}
+}
+
+func TestValidateOutput(t *testing.T) {
+	in, err := ioutil.ReadAll(generateTestString())
+	if err != nil {
+		t.Fatalf("Failed to read large string: %v", err)
+	}
+	inputs := [][]byte{in, []byte("\xed\xa0\x80\xf4\x90\x80\x80\xc0\xaf\xe2\x98\xff  \U000e0001")}
+	for _, tt := range quotetests {
+		inputs = append(inputs, []byte(tt.in))
+	}
+	for _, opts := range [][]Option{{WithGraphic()}, {WithMinimalEscaping()}, {WithLiteralWhitespace()}, {WithInvalidUTF8(ReplacementChar)}} {
+		converter := New(append(opts, WithValidateOutput())...)
+		for _, in := range inputs {
+			if _, err := converter.Convert(bytes.NewReader(in), ioutil.Discard); err != nil {
+				t.Errorf("Converter failed for %.20q: %v", in, err)
+			}
+		}
+	}
+
+	tests := []struct {
+		opts     []Option
+		expected string
+	}{
+		{[]Option{WithCSV()}, `"a`},
+		{[]Option{WithInvalidReplacement([]byte("\xff"))}, "a"},
+		{[]Option{WithByteRanges(nil), WithQuotes()}, `"`},
+		{[]Option{WithReplacement('$', []byte("\xff"))}, "a"},
+		{[]Option{WithShortEscapes(map[rune][]byte{'\n': []byte("\xff")})}, "a$"},
+	}
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		_, err := New(append(tt.opts, WithValidateOutput())...).Convert(strings.NewReader("a$\n\xffb"), &buffer)
+		if !errors.Is(err, ErrInvalidOutput) {
+			t.Errorf("Expected %v, got %v", ErrInvalidOutput, err)
+		}
+		if out := buffer.String(); !strings.HasPrefix(out, tt.expected) || strings.Contains(out, "\xff") {
+			t.Errorf("Expected output starting with %s, got %q", tt.expected, out)
+		}
+	}
+}
+
+func TestExpandTabs(t *testing.T) {
+	tests := []struct {
+		opts     []Option
+		in       string
+		expected string
+	}{
+		{[]Option{WithExpandTabs(4)}, "a\tbc\td", "a   bc  d"},
+		{[]Option{WithExpandTabs(4), WithQuotes()}, "a\tbc\td", `"a  bc  d"`},
+		{[]Option{WithExpandTabs(4)}, "\t\tabcd\t", "        abcd    "},
+		{[]Option{WithExpandTabs(4)}, "☺\tx\n\ty", `☺   x\n y`},
+		{[]Option{WithExpandTabs(4), WithLiteralWhitespace()}, "ab\n\tc", "ab\n    c"},
+		{[]Option{WithExpandTabs(4), WithLineWrap(6, "")}, "abcd\tx", "abcd\n    x"},
+		{[]Option{WithExpandTabs(8), WithPrefix([]byte("x = "))}, "a\tb", "x = a   b"},
+		{[]Option{WithExpandTabs(0)}, "a\tb", `a\tb`},
+		{[]Option{WithExpandTabs(4), WithPercentEncoding("")}, "a\tb", "a%09b"},
+	}
+	for _, tt := range tests {
+		converter := New(tt.opts...)
+		out, err := converter.ConvertAll(strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if string(out) != tt.expected {
+			t.Errorf("Convert(%q) = %q, want %q", tt.in, out, tt.expected)
+		}
+		var buffer bytes.Buffer
+		if _, err := converter.ConvertRunes([]rune(tt.in), &buffer); err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if buffer.String() != tt.expected {
+			t.Errorf("ConvertRunes(%q) = %q, want %q", tt.in, buffer.String(), tt.expected)
+		}
+	}
+}
+
+func TestFixedWidth(t *testing.T) {
+	tests := []struct {
+		opts     []Option
+		in       string
+		expected string
+	}{
+		{[]Option{WithFixedWidth(8), WithASCII()}, "a\u263ab", `a       \u263a  b       `},
+		{[]Option{WithFixedWidth(8), WithASCII(), WithQuotes()}, "a\u263a", `"a       \u263a  "`},
+		{[]Option{WithFixedWidth(2)}, "ab\n", `a b \n`},
+		{[]Option{WithFixedWidth(2), WithLineWrap(4, "")}, "abc", "a b \nc "},
+		{[]Option{WithFixedWidth(4), WithExpandTabs(4)}, "a\tb", "a       b   "},
+		{[]Option{WithFixedWidth(4), WithPercentEncoding("")}, "a b", "a   %20 b   "},
+		{[]Option{WithFixedWidth(0)}, "ab", "ab"},
+	}
+	for _, tt := range tests {
+		converter := New(tt.opts...)
+		out, err := converter.ConvertAll(strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if string(out) != tt.expected {
+			t.Errorf("Convert(%q) = %q, want %q", tt.in, out, tt.expected)
+		}
+		var buffer bytes.Buffer
+		if _, err := converter.ConvertRunes([]rune(tt.in), &buffer); err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if buffer.String() != tt.expected {
+			t.Errorf("ConvertRunes(%q) = %q, want %q", tt.in, buffer.String(), tt.expected)
+		}
+	}
+
+	// dropped input isn't padded
+	out, err := New(WithFixedWidth(2), WithInvalidUTF8(Drop)).ConvertAll(strings.NewReader("a\xffb"))
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if string(out) != "a b " {
+		t.Errorf("Convert with Drop = %q, want %q", out, "a b ")
+	}
+
+	_, err = New(WithFixedWidth(4), WithASCII()).Convert(strings.NewReader("a\u263a"), ioutil.Discard)
+	if !errors.Is(err, ErrTooWide) {
+		t.Errorf("Convert returned %v, want %v", err, ErrTooWide)
+	}
+}
+
+func TestFullHexEscape(t *testing.T) {
+	tests := []struct {
+		opts     []Option
+		in       string
+		expected string
+	}{
+		{[]Option{WithFullHexEscape()}, "AB", `\x41\x42`},
+		{[]Option{WithFullHexEscape(), WithQuotes()}, "AB", `"\x41\x42"`},
+		{[]Option{WithFullHexEscape(), WithUppercaseHex()}, "\x00\n\"\\☺\xff", `\x00\x0A\x22\x5C\xE2\x98\xBA\xFF`},
+		{[]Option{WithByteRanges(nil), WithFullHexEscape()}, "a", `\x61`},
+		{[]Option{WithFullHexEscape(), WithByteRanges(nil)}, "a", "a"},
+		{[]Option{WithFullHexEscape()}, "", ""},
+	}
+	for _, tt := range tests {
+		converter := New(tt.opts...)
+		out, err := converter.ConvertAll(strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if string(out) != tt.expected {
+			t.Errorf("Convert(%q) = %s, want %s", tt.in, out, tt.expected)
+		}
+	}
+	if factor := New(WithFullHexEscape()).MaxExpansionFactor(); factor != 4 {
+		t.Errorf("Expected an expansion factor of 4, got %d", factor)
+	}
+}
+
+func TestSurrogatePairEscapes(t *testing.T) {
+	tests := []struct {
+		opts     []Option
+		in       string
+		expected string
+	}{
+		{[]Option{WithSurrogatePairEscapes(), WithASCII()}, "\U0001f600", `\ud83d\ude00`},
+		{[]Option{WithSurrogatePairEscapes(), WithASCII(), WithUppercaseHex()}, "a\u263a\U0010ffff", `a\u263A\uDBFF\uDFFF`},
+		{[]Option{WithSurrogatePairEscapes()}, "\U0001f600\U000e0001", "\U0001f600" + `\udb40\udc01`},
+		{[]Option{WithASCII()}, "\U0001f600", `\U0001f600`},
+	}
+	for _, tt := range tests {
+		out, err := New(tt.opts...).ConvertAll(strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if string(out) != tt.expected {
+			t.Errorf("Convert(%q) = %s, want %s", tt.in, out, tt.expected)
+		}
+	}
+
+	// JSON decodes surrogate pairs
+	in := "emoji: \U0001f600\U0001f4a9, math: \U0001d538, é"
+	out, err := New(WithSurrogatePairEscapes(), WithASCII(), WithQuotes()).ConvertAll(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	var decoded string
+	if err := json.Unmarshal(out, &decoded); err != nil {
+		t.Fatalf("Failed to decode %s: %v", out, err)
+	}
+	if decoded != in {
+		t.Errorf("Expected %q, got %q", in, decoded)
+	}
+}
+
+func TestStrictTrailing(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+		err      error
+	}{
+		{"abc\xf0", `"abc`, ErrUnexpectedEOF},
+		{"abc\xe2\x98", `"abc`, ErrUnexpectedEOF},
+		{"\xf0", `"`, ErrUnexpectedEOF},
+		{"abc☺", `"abc☺"`, nil},
+		{"a\xffb\xf0\x28", `"a\xffb\xf0("`, nil},
+		{"", `""`, nil},
+	}
+	converter := New(WithStrictTrailing(), WithQuotes())
+	for _, tt := range tests {
+		for _, r := range []io.Reader{strings.NewReader(tt.in), iotest.OneByteReader(strings.NewReader(tt.in))} {
+			var buffer bytes.Buffer
+			n, err := converter.Convert(r, &buffer)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("Convert(%q): expected %v, got %v", tt.in, tt.err, err)
+			}
+			if buffer.String() != tt.expected || n != buffer.Len() {
+				t.Errorf("Convert(%q) = %s, %d, want %s", tt.in, buffer.String(), n, tt.expected)
+			}
+		}
+
+		var buffer bytes.Buffer
+		if _, err := converter.ConvertBytes([]byte(tt.in), &buffer); !errors.Is(err, tt.err) {
+			t.Errorf("ConvertBytes(%q): expected %v, got %v", tt.in, tt.err, err)
+		}
+		buffer.Reset()
+		w := NewWriter(&buffer, WithStrictTrailing())
+		w.Write([]byte(tt.in))
+		if err := w.Close(); !errors.Is(err, tt.err) {
+			t.Errorf("Writer with %q: expected %v, got %v", tt.in, tt.err, err)
+		}
+	}
+}
+
+func TestTemplateSafe(t *testing.T) {
+	inputs := []string{
+		"Hello {{.Name}}!",
+		"{{{ }}} {{- .X -}} {",
+		"{",
+		"{{",
+		"a{b}c{{\"\\\n",
+	}
+	for _, in := range inputs {
+		expected, err := New(WithQuotes()).ConvertAll(strings.NewReader(in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		for _, opts := range [][]Option{{WithQuotes(), WithTemplateSafe()}, {WithQuotes(), WithTemplateSafe(), WithBufferSize(utf8.UTFMax)}} {
+			converter := New(opts...)
+			for _, r := range []io.Reader{strings.NewReader(in), iotest.OneByteReader(strings.NewReader(in))} {
+				out, err := converter.ConvertAll(r)
+				if err != nil {
+					t.Fatalf("Converter failed: %v", err)
+				}
+				tmpl, err := template.New("test").Parse("s := " + string(out))
+				if err != nil {
+					t.Fatalf("Failed to parse %s: %v", out, err)
+				}
+				var buffer bytes.Buffer
+				if err := tmpl.Execute(&buffer, map[string]string{"Name": "x", "X": "y"}); err != nil {
+					t.Fatalf("Failed to execute %s: %v", out, err)
+				}
+				if rendered := buffer.String(); rendered != "s := "+string(expected) {
+					t.Errorf("Template %s rendered %s, want s := %s", out, rendered, expected)
+				}
+			}
+			var buffer bytes.Buffer
+			if _, err := converter.ConvertRunes([]rune(in), &buffer); err != nil {
+				t.Fatalf("Converter failed: %v", err)
+			}
+			out, err := converter.ConvertAll(strings.NewReader(in))
+			if err != nil {
+				t.Fatalf("Converter failed: %v", err)
+			}
+			if buffer.String() != string(out) {
+				t.Errorf("ConvertRunes(%q) = %s, want %s", in, buffer.String(), out)
+			}
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package streamquote
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// quoteReader reads the double-quoted Go string literal of s.
+type quoteReader struct {
+	s       string
+	started bool
+	done    bool
+	// pending is the part of the last escape sequence
+	// that didn't fit into the caller's buffer.
+	pending []byte
+	scratch [10]byte
+}
+
+var (
+	_ io.Reader = (*quoteReader)(nil)
+	_ io.Reader = (*runeLimitReader)(nil)
+	_ io.Reader = (*lineReader)(nil)
+)
+
+// QuoteReader returns a reader of the double-quoted Go string literal
+// representing s, like strconv.Quote(s). The quoted string is produced
+// on demand as it's read, it's never built in memory.
+func QuoteReader(s string) io.Reader {
+	return &quoteReader{s: s}
+}
+
+func (q *quoteReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(q.pending) > 0 {
+			k := copy(p[n:], q.pending)
+			q.pending = q.pending[k:]
+			n += k
+			continue
+		}
+		if !q.started {
+			q.started = true
+			q.pending = append(q.scratch[:0], '"')
+			continue
+		}
+		if len(q.s) == 0 {
+			if q.done {
+				break
+			}
+			q.done = true
+			q.pending = append(q.scratch[:0], '"')
+			continue
+		}
+		r, width := utf8.DecodeRuneInString(q.s)
+		switch {
+		case width == 1 && r == utf8.RuneError:
+			q.pending = appendEscapedByte(q.scratch[:0], q.s[0], lowerhex)
+		case needsEscape(r, '"', false):
+			q.pending = appendEscapedRune(q.scratch[:0], r, '"', false, &goStyle)
+		default:
+			q.pending = append(q.scratch[:0], q.s[:width]...)
+		}
+		q.s = q.s[width:]
+	}
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// runeLimitReader reads the first n bytes from r,
+// and then the rest of the rune the limit fell in, if any.
+type runeLimitReader struct {
+	r io.Reader
+	n int
+	// tail holds the last bytes read
+	tail    [utf8.UTFMax]byte
+	tailLen int
+}
+
+func (l *runeLimitReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if l.n <= 0 {
+		return l.completeRune(p)
+	}
+	if len(p) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= n
+	l.remember(p[:n])
+	return n, err
+}
+
+// remember adds p to the tail.
+func (l *runeLimitReader) remember(p []byte) {
+	if len(p) >= len(l.tail) {
+		l.tailLen = copy(l.tail[:], p[len(p)-len(l.tail):])
+		return
+	}
+	keep := len(l.tail) - len(p)
+	if keep > l.tailLen {
+		keep = l.tailLen
+	}
+	copy(l.tail[:], l.tail[l.tailLen-keep:l.tailLen])
+	l.tailLen = keep + copy(l.tail[keep:], p)
+}
+
+// incomplete returns the start of the incomplete rune
+// at the end of the data read so far, if there is one.
+func (l *runeLimitReader) incomplete() []byte {
+	tail := l.tail[:l.tailLen]
+	n := incompleteRune(tail)
+	if n == 0 {
+		return nil
+	}
+	return tail[len(tail)-n:]
+}
+
+// incompleteRune returns the length of the incomplete rune
+// at the end of data, or 0 if there isn't one.
+func incompleteRune(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if utf8.FullRune(data[i:]) {
+				return 0
+			}
+			return len(data) - i
+		}
+	}
+	return 0
+}
+
+// completeRune reads the next byte of the incomplete rune
+// at the limit into p.
+func (l *runeLimitReader) completeRune(p []byte) (int, error) {
+	partial := l.incomplete()
+	if partial == nil {
+		return 0, io.EOF
+	}
+	scanner, isScanner := l.r.(io.ByteScanner)
+	if isScanner {
+		b, err := scanner.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		p[0] = b
+	} else if n, err := l.r.Read(p[:1]); n == 0 {
+		return 0, err
+	}
+
+	var buf [utf8.UTFMax]byte
+	candidate := append(append(buf[:0], partial...), p[0])
+	if r, width := utf8.DecodeRune(candidate); utf8.FullRune(candidate) && r == utf8.RuneError && width == 1 {
+		// the byte is not part of the rune
+		l.tailLen = 0
+		if isScanner {
+			if err := scanner.UnreadByte(); err == nil {
+				return 0, io.EOF
+			}
+		}
+	} else {
+		l.remember(p[:1])
+	}
+	return 1, nil
+}
+
+// skipContinuation reads the first byte of r that's not a UTF-8
+// continuation byte, skipping up to utf8.UTFMax-1 continuation bytes.
+// If skip is false, it fails with ErrMidRune instead of skipping.
+// It returns the byte read, if any.
+func skipContinuation(r io.Reader, skip bool) ([]byte, error) {
+	var b [1]byte
+	for skipped, emptyReads := 0, 0; ; {
+		n, err := r.Read(b[:])
+		if n == 0 {
+			if err == io.EOF {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("streamquote: read error: %w", err)
+			}
+			if emptyReads++; emptyReads >= maxConsecutiveEmptyReads {
+				return nil, fmt.Errorf("streamquote: read error: %w", io.ErrNoProgress)
+			}
+			continue
+		}
+		emptyReads = 0
+		if utf8.RuneStart(b[0]) || skipped == utf8.UTFMax-1 {
+			return b[:], nil
+		}
+		if !skip {
+			return nil, fmt.Errorf("%w: it starts with %#x", ErrMidRune, b[0])
+		}
+		skipped++
+	}
+}
+
+// lineReader reads a line from r, without the newline at its end.
+// The newline is consumed, so that r is left at the start of the next line.
+type lineReader struct {
+	r    *bufio.Reader
+	done bool
+}
+
+func (l *lineReader) Read(p []byte) (int, error) {
+	if l.done {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if l.r.Buffered() == 0 {
+		if _, err := l.r.Peek(1); err != nil {
+			return 0, err
+		}
+	}
+	buf, _ := l.r.Peek(l.r.Buffered())
+	if end := bytes.IndexByte(buf, '\n'); end >= 0 && end <= len(p) {
+		// the rest of the line fits, skip the newline too
+		n := copy(p, buf[:end])
+		l.r.Discard(n + 1)
+		l.done = true
+		return n, nil
+	}
+	n := copy(p, buf)
+	l.r.Discard(n)
+	return n, nil
+}
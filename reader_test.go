@@ -0,0 +1,52 @@
+package streamquote
+
+import (
+	"io"
+	"io/ioutil"
+	"strconv"
+	"testing"
+	"testing/iotest"
+)
+
+func TestQuoteReader(t *testing.T) {
+	for _, tt := range quotetests {
+		out, err := ioutil.ReadAll(QuoteReader(tt.in))
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if !testEqual(string(out), tt.out) {
+			t.Errorf("QuoteReader(%s) = %s, want %s", tt.in, out, tt.out)
+		}
+	}
+}
+
+// TestQuoteReaderOneByte tests that escape sequences
+// are split correctly across reads.
+func TestQuoteReaderOneByte(t *testing.T) {
+	in := "a\x00\xff☺\U0010ffff\"\\\n"
+	expected := strconv.Quote(in)
+	r := QuoteReader(in)
+	var out []byte
+	var buf [1]byte
+	for {
+		n, err := r.Read(buf[:])
+		out = append(out, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+	}
+	if string(out) != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+
+	out, err := ioutil.ReadAll(iotest.HalfReader(QuoteReader(in)))
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(out) != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+}
@@ -2,13 +2,27 @@
 package streamquote
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf16"
 	"unicode/utf8"
 )
 
 // Converter converts data by escaping control characters and
 // non-printable characters using Go escape sequences.
+// It's implemented by Quoter, which has the other ways to run a
+// conversion. Converter only has Convert, so that it's easy to implement
+// and to mock. Functions that need more than Convert take a *Quoter.
 type Converter interface {
 	// Convert converts the data in "in", writing it to "out".
 	// It uses Go escape sequences (\t, \n, \xFF, \u0100) for control characters
@@ -17,155 +31,2026 @@ type Converter interface {
 	Convert(in io.Reader, out io.Writer) (int, error)
 }
 
-const bufSize = 100 * 1024
+// BufferStats holds statistics about how the read buffer was used during
+// a conversion, to help choose WithBufferSize and WithReadChunkSize.
+type BufferStats struct {
+	// Refills is the number of reads that returned data.
+	Refills int
+	// MaxFill is the most bytes the buffer held after a read,
+	// including the data left over from the previous read,
+	// like the start of an incomplete rune.
+	MaxFill int
+	// BytesRead is the number of bytes read, so the average number
+	// of bytes read per refill is BytesRead / Refills.
+	BytesRead int64
+}
+
+// Stats holds statistics about a conversion.
+type Stats struct {
+	// RunesTotal is the number of runes in the input.
+	// Each invalid byte counts as one rune.
+	RunesTotal int
+	// RunesEscaped is the number of valid runes that were escaped.
+	RunesEscaped int
+	// InvalidBytes is the number of bytes that were not valid UTF-8.
+	// These are always escaped.
+	InvalidBytes int
+	// BytesWritten is the number of bytes written to the output.
+	BytesWritten int
+}
+
+// ErrOutputTooLarge is returned by Convert if the converted data
+// would exceed the limit set by WithMaxOutput.
+var ErrOutputTooLarge = errors.New("streamquote: output too large")
 
-const lowerhex = "0123456789abcdef"
+// ErrInvalidUTF8 is returned by Convert if the input is not valid UTF-8
+// and WithStrictUTF8 is used. The returned error is an *InvalidUTF8Error,
+// use errors.Is to check for it.
+var ErrInvalidUTF8 = errors.New("streamquote: invalid UTF-8")
 
-type converter struct {
-	readBuffer  [bufSize]byte
-	writeBuffer [10]byte
+// InvalidUTF8Error reports the position of the first invalid byte.
+type InvalidUTF8Error struct {
+	// Offset is the offset of the invalid byte in the input.
+	Offset int
 }
 
-// New returns a new Converter.
-func New() Converter {
-	return &converter{}
+func (e *InvalidUTF8Error) Error() string {
+	return fmt.Sprintf("streamquote: invalid UTF-8 at offset %d", e.Offset)
+}
+
+// Is reports whether target is ErrInvalidUTF8.
+func (e *InvalidUTF8Error) Is(target error) bool {
+	return target == ErrInvalidUTF8
+}
+
+// ErrNilReader is returned by Convert if the reader is nil.
+var ErrNilReader = errors.New("streamquote: nil reader")
+
+// ErrNilWriter is returned by Convert if the writer is nil.
+var ErrNilWriter = errors.New("streamquote: nil writer")
+
+// ErrBadWriter is returned by Convert if the writer reports writing
+// a negative number of bytes, or more than it was given.
+var ErrBadWriter = errors.New("streamquote: writer returned invalid count")
+
+// ErrShortWrite is returned by Convert if the writer writes less than
+// it was given, without returning an error. It's io.ErrShortWrite, so
+// errors.Is works with either.
+var ErrShortWrite = io.ErrShortWrite
+
+// ErrConverterInUse is returned if a conversion is started while another
+// one is in progress on the same converter, like from the callback of
+// WithProgress or from an Escaper. Use Clone to get another converter.
+var ErrConverterInUse = errors.New("streamquote: converter already in use")
+
+// ErrSharedHash is returned by the conversions of a clone of a converter
+// that uses WithHash, because a hash.Hash can't be written by both of
+// them. Use New with a new hash instead of Clone.
+var ErrSharedHash = errors.New("streamquote: clone can't share the hash of WithHash")
+
+// ErrConflictingOptions is returned by NewWithOptions
+// if the options contradict each other.
+var ErrConflictingOptions = errors.New("streamquote: conflicting options")
+
+// ErrInvalidHexAlphabet is returned by Convert
+// if WithHexAlphabet was used with an invalid alphabet.
+var ErrInvalidHexAlphabet = errors.New("streamquote: invalid hex alphabet")
+
+// ErrInvalidShortEscape is returned by Convert
+// if WithShortEscapes was used with a rune that's not a control character.
+var ErrInvalidShortEscape = errors.New("streamquote: invalid short escape")
+
+// ErrInvalidGoLiteral is returned by Convert if WithVerifyGoLiteral
+// is used, and the output is not a Go string literal of the input.
+var ErrInvalidGoLiteral = errors.New("streamquote: output is not a Go string literal of the input")
+
+// ErrInvalidOutput is returned by Convert if WithValidateOutput
+// is used, and the output would contain invalid UTF-8.
+var ErrInvalidOutput = errors.New("streamquote: invalid UTF-8 in output")
+
+// ErrUnexpectedEOF is returned by Convert if WithStrictTrailing is used,
+// and the input ends with an incomplete multi-byte rune.
+// It's io.ErrUnexpectedEOF, so errors.Is works with either.
+var ErrUnexpectedEOF = io.ErrUnexpectedEOF
+
+// ErrMidRune is returned by ConvertResume if the input starts inside
+// a multi-byte rune, and it was expected to start at a rune boundary.
+var ErrMidRune = errors.New("streamquote: resuming in the middle of a rune")
+
+// ErrBufferTooSmall is returned by Convert if the buffer size
+// is less than utf8.UTFMax.
+var ErrBufferTooSmall = errors.New("streamquote: buffer too small")
+
+// ErrTooWide is returned by Convert if WithFixedWidth is used and the
+// output of a rune is wider than the fixed width.
+var ErrTooWide = errors.New("streamquote: escape wider than the fixed width")
+
+var newline = []byte{'\n'}
+
+// bom is the UTF-8 encoding of the byte order mark U+FEFF.
+var bom = []byte{0xef, 0xbb, 0xbf}
+
+// templateBrace is a text/template action that writes a left brace.
+var templateBrace = []byte(`{{"{"}}`)
+
+// DefaultBufferSize is the size of the buffer the data read
+// from the reader is converted in, unless WithBufferSize is used.
+const DefaultBufferSize = 100 * 1024
+
+// outBufSize is the size of the output buffer. Converted data is
+// collected in the output buffer and written to the writer in chunks.
+const outBufSize = 32 * 1024
+
+const (
+	lowerhex = "0123456789abcdef"
+	upperhex = "0123456789ABCDEF"
+)
+
+// maxConsecutiveEmptyReads is the number of reads returning
+// no data and no error after which Convert gives up.
+const maxConsecutiveEmptyReads = 100
+
+// Quoter is the Converter returned by New, configured by the options.
+// Besides Convert, it has variants of it that report more about the
+// conversion, or that convert the input differently.
+// It is not safe for concurrent use, use Clone to get another one.
+type Quoter struct {
+	readBuffer []byte
+	bufferSize int
+	// readChunk is the most bytes read at a time, if it's not 0
+	readChunk   int
+	writeBuffer [12]byte
+	// runeBuffer holds the encoding of the rune being converted
+	// by ConvertRunes, so that it doesn't have to be allocated
+	runeBuffer [utf8.UTFMax]byte
+	// escapes are the escape sequences of ASCII bytes, if they can be used
+	escapes      *escapeTable
+	escapeBuffer [512]byte
+	outBuffer    []byte
+	out          io.Writer
+	// outSize is the size at which the output buffer is flushed
+	outSize    int
+	flushAlign int
+
+	maxOutput int64
+
+	wrapCols     int
+	continuation []byte
+
+	quotes    bool
+	delimiter rune
+	// opening and closing delimiters added by WithQuotes
+	open, close []byte
+	// safe is the table of bytes that are written without escaping
+	safe [256]bool
+
+	literalWhitespace bool
+
+	ascii   bool
+	graphic bool
+	minimal bool
+
+	invalidUTF8 InvalidUTF8Mode
+	strictUTF8  bool
+
+	nulShortForm bool
+	// normalizeNewlines drops the \r of \r\n
+	normalizeNewlines bool
+	// escapeSurrogates is set by WithEscapeSurrogates
+	escapeSurrogates bool
+	// percent selects percent-encoding, leaving the unreserved
+	// characters and the bytes in percentSafe unencoded
+	percent     bool
+	percentSafe string
+
+	// byteRanges are set by WithByteRanges,
+	// it's nil if it's not used
+	byteRanges []ByteRange
+
+	autoFlush bool
+
+	byteSlice bool
+
+	trackPosition bool
+
+	html bool
+
+	style escapeStyle
+
+	// alwaysEscape are the runes backslashed in addition to
+	// the delimiter and the backslash.
+	alwaysEscape []rune
+	// tabWidth and tabSpaces are set by WithExpandTabs
+	tabWidth  int
+	tabSpaces []byte
+	// fixedWidth and fixedPad are set by WithFixedWidth
+	fixedWidth int
+	fixedPad   []byte
+
+	// validateOutput is set by WithValidateOutput
+	validateOutput bool
+	// plainRunes is set if runes are written without wrapping or padding
+	plainRunes bool
+
+	// rotate returns the next writer once rotateSize bytes
+	// were written to the current one, in ConvertRotating
+	rotate     func() (io.Writer, error)
+	rotateSize int64
+
+	// templateSafe is set by WithTemplateSafe
+	templateSafe bool
+
+	// strictTrailing is set by WithStrictTrailing
+	strictTrailing bool
+
+	// joining is set during ConvertJoin, and joinSep
+	// is the separator written before the current item
+	joining bool
+	joinSep []byte
+
+	// resume is set during ConvertResume
+	resume bool
+
+	// invalidReplacement is set by WithInvalidReplacement,
+	// it's nil if it's not used
+	invalidReplacement []byte
+
+	// replacements are set by WithReplacement
+	replacements []replacement
+
+	progress func(readBytes, writtenBytes int)
+
+	stripBOM bool
+
+	trailingNewline bool
+
+	verify bool
+
+	hash hash.Hash
+
+	// framed is set by WithFramedOutput,
+	// frameHeader holds the length of the chunk being written
+	framed      bool
+	frameHeader [4]byte
+
+	// messages is set by WithMessageBoundaries
+	messages bool
+
+	// versionHeader is set by WithVersionHeader,
+	// header is the header it writes
+	versionHeader bool
+	header        []byte
+
+	// the rune limit of ConvertDisplay
+	limitRunes bool
+	maxRunes   int
+	ellipsis   []byte
+
+	// written before and after everything else
+	prefix, suffix []byte
+
+	// optErr is the first error reported by an option.
+	// Conversions fail with it.
+	optErr error
+
+	interrupt context.Context
+
+	// keepTail is set by ConvertPartial
+	keepTail bool
+
+	// classifier is set by WithClassifier
+	classifier func(r rune) bool
+
+	// escaper is set by WithEscaper
+	escaper Escaper
+
+	state conversionState
+	// totalWritten is the number of bytes written by all conversions
+	totalWritten int64
+}
+
+var (
+	_ Converter = (*Quoter)(nil)
+	_ io.Writer = (*sliceWriter)(nil)
+)
+
+// New returns a new Quoter configured by opts.
+func New(opts ...Option) *Quoter {
+	return newConverter(opts...)
+}
+
+// NewWithBuffer returns a new Quoter configured by opts, that converts
+// the data read from the reader in buf, instead of allocating its own
+// buffer. The converter doesn't copy buf, so it must not be used for
+// anything else while the converter is in use. buf has to be at least
+// utf8.UTFMax bytes long, otherwise conversions fail with an error
+// wrapping ErrBufferTooSmall. WithBufferSize is ignored.
+func NewWithBuffer(buf []byte, opts ...Option) *Quoter {
+	c := newConverter(opts...)
+	if len(buf) < utf8.UTFMax {
+		c.setErr(fmt.Errorf("%w: %d bytes", ErrBufferTooSmall, len(buf)))
+		return c
+	}
+	c.readBuffer = buf
+	c.bufferSize = len(buf)
+	return c
+}
+
+// NewWithOptions returns a new Quoter configured by opts, like New,
+// but it fails if an option is invalid, or if the options conflict.
+// Conflicts are reported with an error wrapping ErrConflictingOptions.
+// The following options conflict:
+//
+//	WithASCII          WithGraphic
+//	WithASCII          WithMinimalEscaping
+//	WithGraphic        WithMinimalEscaping
+//	WithQuotes         WithLiteralWhitespace
+//	WithStrictUTF8     WithInvalidUTF8, with a mode other than EscapeHex
+func NewWithOptions(opts ...Option) (*Quoter, error) {
+	c := newConverter(opts...)
+	if c.optErr != nil {
+		return nil, c.optErr
+	}
+	if err := c.checkConflicts(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newConverter(opts ...Option) *Quoter {
+	c := &Quoter{
+		delimiter:  '"',
+		style:      goStyle,
+		bufferSize: DefaultBufferSize,
+		ellipsis:   []byte("..."),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.style.csv {
+		c.delimiter = '"'
+		c.quotes = true
+	}
+	if c.percent {
+		c.quotes = false
+	}
+	if strings.ContainsRune(c.style.hex, c.delimiter) {
+		// an escape ending in the delimiter would end the string
+		c.setErr(fmt.Errorf("%w: %q contains the delimiter %q", ErrInvalidHexAlphabet, c.style.hex, c.delimiter))
+	}
+	if c.byteSlice {
+		c.open = []byte("[]byte{")
+		c.close = []byte("}")
+	} else {
+		c.open = appendRune(nil, c.delimiter)
+		c.close = c.open
+	}
+	c.outSize = outBufSize
+	if c.flushAlign > 0 {
+		// round up, so that a full buffer has at least one aligned block
+		c.outSize = (outBufSize + c.flushAlign - 1) / c.flushAlign * c.flushAlign
+	}
+	c.safe = newSafeTable(c.delimiter)
+	for _, r := range c.alwaysEscape {
+		if r < utf8.RuneSelf {
+			c.safe[r] = false
+		}
+	}
+	for _, rep := range c.replacements {
+		if rep.r >= 0 && rep.r < utf8.RuneSelf {
+			c.safe[rep.r] = false
+		}
+	}
+	if c.classifier != nil {
+		for b := range c.safe[:utf8.RuneSelf] {
+			c.safe[b] = c.safe[b] && c.classifier(rune(b))
+		}
+	}
+	if c.html {
+		for b, entity := range htmlEntities {
+			if entity != "" {
+				c.safe[b] = false
+			}
+		}
+	}
+	if c.style.csv {
+		for b := 0; b < utf8.RuneSelf; b++ {
+			c.safe[b] = b != '"'
+		}
+	}
+	if c.escaper != nil {
+		// the escaper decides about every byte
+		c.safe = [256]bool{}
+	}
+	if c.percent {
+		c.safe = newPercentSafeTable(c.percentSafe)
+	}
+	if c.byteRanges != nil {
+		c.safe = newByteRangeSafeTable(c.byteRanges)
+	}
+	if c.tabWidth > 0 && !c.bytewise() {
+		c.safe['\t'] = false
+	}
+	if c.templateSafe && !c.bytewise() {
+		c.safe['{'] = false
+	}
+	if c.versionHeader {
+		mode, ok := c.headerMode()
+		if !ok {
+			c.setErr(fmt.Errorf("%w: WithVersionHeader and options whose output Unconvert can't decode", ErrConflictingOptions))
+		}
+		c.header = appendHeader(nil, mode)
+	}
+	c.plainRunes = c.wrapCols == 0 && c.fixedWidth == 0
+	c.escapes = c.newEscapeTable()
+	return c
 }
 
 // Convert converts the data in "in", writing it to "out".
 // It uses Go escape sequences (\t, \n, \xFF, \u0100) for control characters
 // and non-printable characters as defined by strconv.IsPrint.
 // It is not safe for concurrent use.
-func (c *converter) Convert(in io.Reader, out io.Writer) (int, error) {
-	var err error
-	bufSize := len(c.readBuffer)
-	n := 0
+func (c *Quoter) Convert(in io.Reader, out io.Writer) (int, error) {
+	stats, err := c.convert(in, out)
+	return stats.BytesWritten, err
+}
+
+// ConvertStats converts the data in "in", writing it to "out",
+// like Convert, and returns statistics about the conversion.
+func (c *Quoter) ConvertStats(in io.Reader, out io.Writer) (Stats, error) {
+	return c.convert(in, out)
+}
+
+// ConvertRuneCount converts the data in "in", writing it to "out",
+// like Convert, and returns the number of runes in the input,
+// counting each invalid byte as one rune. It's the same as
+// Stats.RunesTotal. With WithByteSlice, WithPercentEncoding and
+// WithByteRanges the input isn't decoded, and no runes are counted.
+func (c *Quoter) ConvertRuneCount(in io.Reader, out io.Writer) (runes, written int, err error) {
+	stats, err := c.convert(in, out)
+	return stats.RunesTotal, stats.BytesWritten, err
+}
+
+// ConvertIfNeeded converts the data in "in", writing it to "out",
+// like Convert, and reports whether any rune had to be escaped, or
+// any invalid byte escaped or replaced. The delimiters added by
+// WithQuotes don't count as a change.
+// If changed is false, the converted data is the same as the input.
+func (c *Quoter) ConvertIfNeeded(in io.Reader, out io.Writer) (written int, changed bool, err error) {
+	stats, err := c.convert(in, out)
+	changed = stats.RunesEscaped > 0 || stats.InvalidBytes > 0
+	return stats.BytesWritten, changed, err
+}
+
+// ConvertTee converts the data in "in", writing it to all of outs.
+// Converted data is written in chunks, each chunk is written to
+// the writers in order. If a writer returns an error or writes less
+// than the whole chunk, the conversion stops, and the chunk is not
+// written to the remaining writers. In that case the returned count
+// is the number of bytes the failing writer accepted.
+// If outs is empty, or any of them is nil, it fails with ErrNilWriter
+// before converting anything.
+func (c *Quoter) ConvertTee(in io.Reader, outs ...io.Writer) (int, error) {
+	if len(outs) == 0 {
+		return 0, ErrNilWriter
+	}
+	for _, out := range outs {
+		if out == nil {
+			return 0, ErrNilWriter
+		}
+	}
+	return c.Convert(in, io.MultiWriter(outs...))
+}
+
+// ConvertAll converts the data in "in", and returns the converted data.
+// If "in" has a Len method, like bytes.Reader and strings.Reader,
+// it's used to allocate a large enough slice up front.
+func (c *Quoter) ConvertAll(in io.Reader) ([]byte, error) {
+	w := sliceWriter(make([]byte, 0, estimateSize(in)))
+	_, err := c.Convert(in, &w)
+	return w, err
+}
+
+// ConvertToBuilder converts the data in "in", appending it to sb.
+// Like ConvertAll, if "in" has a Len method, it's used to grow sb
+// up front, so that building the string takes as few allocations
+// as possible.
+func (c *Quoter) ConvertToBuilder(in io.Reader, sb *strings.Builder) (int, error) {
+	return c.Convert(in, sb)
+}
+
+// ConvertCount converts the data in "in" without writing it anywhere,
+// and returns the number of bytes Convert would have written.
+// The output doesn't count towards TotalWritten.
+// Use ConvertStats with ioutil.Discard to get the statistics too.
+func (c *Quoter) ConvertCount(in io.Reader) (written int, err error) {
+	total := c.totalWritten
+	written, err = c.Convert(in, ioutil.Discard)
+	if !errors.Is(err, ErrConverterInUse) {
+		c.totalWritten = total
+	}
+	return written, err
+}
 
-	var processed = bufSize
+// ConvertBytes converts the data in src, writing it to "out".
+// It's the same as calling Convert with a bytes.Reader,
+// but it doesn't need to copy src into the read buffer.
+func (c *Quoter) ConvertBytes(src []byte, out io.Writer) (int, error) {
+	if c.inUse() {
+		return 0, ErrConverterInUse
+	}
+	err := c.begin(out)
+	if err == nil {
+		growBuffer(out, estimateLen(len(src)))
+		_, err = c.convertFinal(src)
+	}
+	stats, err := c.end(err)
+	return stats.BytesWritten, err
+}
+
+// ConvertLimit converts the first n bytes of "in", writing them to "out".
+// If the limit falls inside a multi-byte rune, the rest of the rune is
+// read and converted too, one byte at a time, so that "in" is left right
+// after the converted data. If the limit falls inside an invalid sequence,
+// the byte that shows it's invalid is put back with UnreadByte if "in"
+// is an io.ByteScanner, and converted otherwise.
+func (c *Quoter) ConvertLimit(in io.Reader, out io.Writer, n int) (int, error) {
+	if in == nil {
+		return 0, ErrNilReader
+	}
+	stats, err := c.convert(&runeLimitReader{r: in, n: n}, out)
+	return stats.BytesWritten, err
+}
+
+// ConvertDisplay converts at most maxRunes runes of "in", writing them to
+// "out". If there was more input, it writes the ellipsis set by WithEllipsis
+// ("..." by default) after the converted data, and after the closing quote
+// if WithQuotes is used, so that the output is still a valid string literal,
+// and reports that the output was truncated. Runes are counted in the input,
+// each invalid byte counts as one rune. Multi-byte runes are never cut.
+// To find out whether there is more input, "in" may be read past the runes
+// that were converted. With WithByteSlice, the input is not truncated.
+func (c *Quoter) ConvertDisplay(in io.Reader, out io.Writer, maxRunes int) (written int, truncated bool, err error) {
+	if in == nil {
+		return 0, false, ErrNilReader
+	}
+	if c.inUse() {
+		return 0, false, ErrConverterInUse
+	}
+	if maxRunes < 0 {
+		maxRunes = 0
+	}
+	c.limitRunes, c.maxRunes = true, maxRunes
+	defer func() {
+		c.limitRunes, c.maxRunes = false, 0
+	}()
+	stats, err := c.convert(in, out)
+	return stats.BytesWritten, c.state.truncated, err
+}
+
+// ConvertPartial converts the data in "in", writing it to "out", like
+// Convert, but if the input ends with an incomplete multi-byte rune, its
+// bytes are returned in tail instead of being escaped as invalid UTF-8,
+// so that they can be prepended to the input of the next conversion.
+// tail is nil if the input ends with a complete rune or an invalid byte.
+// If reading fails, the incomplete rune before the error is still
+// returned in tail.
+func (c *Quoter) ConvertPartial(in io.Reader, out io.Writer) (written int, tail []byte, err error) {
+	if c.inUse() {
+		return 0, nil, ErrConverterInUse
+	}
+	c.keepTail = true
+	defer func() {
+		c.keepTail = false
+	}()
+	stats, err := c.convert(in, out)
+	return stats.BytesWritten, c.state.tail, err
+}
+
+// ConvertResume continues a conversion of a large input that stopped
+// before the data in "in", for example because the program was restarted,
+// writing it to "out". The caller is expected to have positioned "in" at
+// the offset to resume from, like the number of bytes read reported by
+// WithProgress, and to have kept the output written before it.
+// The prefix and the opening delimiter are not written again, and
+// WithStripBOM has no effect, but the rest of the output is the same as
+// if the conversion hadn't stopped, including the closing delimiter.
+//
+// The offset may be inside a multi-byte rune. If atRuneBoundary is true,
+// the caller expects it not to be, and ConvertResume returns an error
+// wrapping ErrMidRune without converting anything if "in" starts with
+// a UTF-8 continuation byte. If it's false, up to three continuation bytes
+// at the start are skipped, as the end of a rune that started before the
+// offset. In both cases a continuation byte is taken to be part of a rune,
+// even if it was invalid UTF-8 in the original input. With WithByteSlice,
+// WithPercentEncoding and WithByteRanges, which convert the input byte by
+// byte, any offset is a boundary, and atRuneBoundary is ignored.
+func (c *Quoter) ConvertResume(in io.Reader, out io.Writer, atRuneBoundary bool) (int, error) {
+	if in == nil {
+		return 0, ErrNilReader
+	}
+	if c.inUse() {
+		return 0, ErrConverterInUse
+	}
+	if !c.byteSlice && !c.bytewise() {
+		first, err := skipContinuation(in, !atRuneBoundary)
+		if err != nil {
+			return 0, err
+		}
+		in = io.MultiReader(bytes.NewReader(first), in)
+	}
+	c.resume = true
+	defer func() {
+		c.resume = false
+	}()
+	return c.Convert(in, out)
+}
+
+// ConvertJoin converts the data in each of "in", writing them to "out"
+// one after the other, separated by sep, like calling Convert for each
+// of them, with the prefix, suffix and delimiters of each, but the
+// converted data is collected in the output buffer, and written once it's
+// full or at the end, instead of at the end of each item. The limits, like
+// WithMaxOutput, apply to each item on its own, and the separator counts
+// towards the item after it. The conversion stops at the first error.
+func (c *Quoter) ConvertJoin(in []io.Reader, sep []byte, out io.Writer) (written int, err error) {
+	if c.inUse() {
+		return 0, ErrConverterInUse
+	}
+	if sep == nil {
+		// the items after the first are told apart by the separator
+		sep = []byte{}
+	}
+	c.joining = true
+	defer func() {
+		c.joining = false
+		c.joinSep = nil
+	}()
+	for i, r := range in {
+		if i > 0 {
+			c.joinSep = sep
+		}
+		var n int
+		n, err = c.Convert(r, out)
+		written += n
+		if err != nil {
+			break
+		}
+	}
+	if out == nil {
+		return written, err
+	}
+
+	// write out the rest of the buffer
+	c.out = out
+	buffered := c.state.stats.BytesWritten
+	flushErr := c.flush()
+	if f, ok := out.(flusher); ok && c.autoFlush && flushErr == nil {
+		flushErr = f.Flush()
+	}
+	lost := buffered - c.state.stats.BytesWritten
+	written -= lost
+	c.totalWritten -= int64(lost)
+	c.out = nil
+	if err == nil {
+		err = flushErr
+	}
+	return written, err
+}
+
+// ConvertRunes converts the runes in src, writing them to "out".
+// Runes that are not valid Unicode code points, including surrogate
+// halves, are escaped as \ufffd in all modes, like decoding invalid UTF-8
+// gives U+FFFD. With WithEscapeSurrogates, surrogate halves are escaped
+// as themselves, like \ud800, instead. With WithByteSlice, invalid runes
+// are encoded as U+FFFD, like utf8.EncodeRune does.
+func (c *Quoter) ConvertRunes(src []rune, out io.Writer) (int, error) {
+	if c.inUse() {
+		return 0, ErrConverterInUse
+	}
+	err := c.begin(out)
+	if err == nil {
+		err = c.convertRunes(src)
+	}
+	stats, err := c.end(err)
+	return stats.BytesWritten, err
+}
+
+// estimateSize returns the estimated size of the converted data in "in".
+func estimateSize(in io.Reader) int {
+	if l, ok := in.(interface{ Len() int }); ok {
+		return estimateLen(l.Len())
+	}
+	return 512
+}
+
+// estimateLen returns the estimated size of n bytes of converted data.
+func estimateLen(n int) int {
+	// leave some room for escape sequences and quotes
+	return n + n/16 + 16
+}
+
+// growBuffer grows out to make room for n more bytes if it's a
+// bytes.Buffer or a strings.Builder, so that it doesn't have to grow
+// repeatedly while the converted data is written to it.
+func growBuffer(out io.Writer, n int) {
+	switch b := out.(type) {
+	case *bytes.Buffer:
+		b.Grow(n)
+	case *strings.Builder:
+		b.Grow(n)
+	}
+}
+
+// sliceWriter is an io.Writer that appends to a byte slice.
+type sliceWriter []byte
+
+func (w *sliceWriter) Write(p []byte) (int, error) {
+	*w = append(*w, p...)
+	return len(p), nil
+}
+
+func (c *Quoter) convert(in io.Reader, out io.Writer) (Stats, error) {
+	if in == nil {
+		return Stats{}, ErrNilReader
+	}
+	if c.inUse() {
+		return Stats{}, ErrConverterInUse
+	}
+	if c.readBuffer == nil {
+		c.readBuffer = make([]byte, c.bufferSize)
+	}
+
+	err := c.begin(out)
+	if err == nil {
+		growBuffer(out, estimateSize(in))
+	}
+	var readErr error
 	var dataLen = 0
+	var eof = false
+	emptyReads := 0
+
+	for err == nil && !eof {
+		buf := c.readBuffer[dataLen:]
+		if c.readChunk > 0 && len(buf) > c.readChunk {
+			buf = buf[:c.readChunk]
+		}
+		var read int
+		read, readErr = in.Read(buf)
+		dataLen += read
+		if read > 0 {
+			c.state.buffer.Refills++
+			c.state.buffer.BytesRead += int64(read)
+			if dataLen > c.state.buffer.MaxFill {
+				c.state.buffer.MaxFill = dataLen
+			}
+		}
+		if read == 0 && readErr == nil {
+			emptyReads++
+			if emptyReads >= maxConsecutiveEmptyReads {
+				readErr = io.ErrNoProgress
+			}
+		} else {
+			emptyReads = 0
+		}
+		if readErr != nil {
+			// convert the data returned along with the error first
+			eof = true
+		}
+		convertLen := dataLen
+		if eof && c.keepTail {
+			convertLen -= incompleteRune(c.readBuffer[:dataLen])
+		}
+		var processed int
+		if eof {
+			processed, err = c.convertFinal(c.readBuffer[:convertLen])
+		} else {
+			processed, err = c.convertData(c.readBuffer[:convertLen], false)
+		}
+		if c.limitRunes && err == nil && c.state.stats.RunesTotal >= c.maxRunes {
+			c.state.truncated = processed < dataLen || !eof && hasMoreData(in, c.readBuffer)
+			if read > 0 {
+				c.reportProgress()
+			}
+			break
+		}
+		dataLen = copy(c.readBuffer, c.readBuffer[processed:dataLen])
+		if c.readChunk > 0 && read > 0 && err == nil {
+			err = c.flushAligned()
+		}
+		if read > 0 {
+			c.reportProgress()
+		}
+	}
+
+	if err == nil && readErr != nil && readErr != io.EOF {
+		err = fmt.Errorf("streamquote: read error after %d bytes: %w", c.state.consumed, readErr)
+	}
+	if c.keepTail && dataLen > 0 {
+		// kept even after an error, the caller may retry with the rest
+		c.state.tail = append([]byte(nil), c.readBuffer[:dataLen]...)
+	}
+	return c.end(err)
+}
+
+// conversionState holds the state of a conversion in progress.
+type conversionState struct {
+	stats Stats
+	// total number of input bytes converted so far
+	consumed int
+	// number of bytes written since the last line wrap
+	column int
+	// whether the previous byte was invalid UTF-8
+	invalid bool
+	// number of newlines written, and the length of the last line,
+	// if position tracking is enabled
+	lines       int
+	lastLineLen int
+	// number of runes written since the last newline,
+	// if tabs are expanded
+	tabColumn int
+	// number of bytes written to the current writer, in ConvertRotating
+	fileWritten int64
+	// how the read buffer was used
+	buffer BufferStats
+	// whether the start of the input was checked for a byte order mark
+	bomChecked bool
+	// the input and the output, if WithVerifyGoLiteral is used,
+	// and where the converted input starts in verifyOut
+	verifyIn, verifyOut []byte
+	verifyStart         int
+	// whether ConvertDisplay stopped before the end of the input
+	truncated bool
+	// the incomplete rune at the end of the input, for ConvertPartial
+	tail []byte
+	// whether write only has to buffer its data, because no option
+	// limits, counts or splits the output
+	plainWrites bool
+}
+
+// hasMoreData reports whether "in" has more data, reading it into buf.
+func hasMoreData(in io.Reader, buf []byte) bool {
+	for i := 0; i < maxConsecutiveEmptyReads; i++ {
+		n, err := in.Read(buf)
+		if n > 0 {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+	}
+	return false
+}
+
+// verifyGoLiteral checks that the output of the conversion
+// is a Go string literal of its input.
+func (c *Quoter) verifyGoLiteral() error {
+	body := c.state.verifyOut[c.state.verifyStart:]
+	if c.quotes {
+		body = body[:len(body)-len(c.close)]
+	}
+	s, err := strconv.Unquote(`"` + string(body) + `"`)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidGoLiteral, err)
+	}
+	if s != string(c.state.verifyIn) {
+		return fmt.Errorf("%w: the unquoted output doesn't match the input", ErrInvalidGoLiteral)
+	}
+	return nil
+}
+
+// begin starts a new conversion writing to out.
+func (c *Quoter) begin(out io.Writer) error {
+	if c.optErr != nil {
+		return c.optErr
+	}
+	if out == nil {
+		return ErrNilWriter
+	}
+	if c.outBuffer == nil {
+		c.outBuffer = make([]byte, 0, c.outSize)
+	}
+	c.out = out
+	c.state = conversionState{}
+	// WithRotatingFiles sets rotate after the options
+	c.state.plainWrites = c.maxOutput == 0 && c.rotate == nil && !c.verify &&
+		c.tabWidth == 0 && !c.trackPosition && !c.messages
+	if c.header != nil && c.joinSep == nil && !c.resume {
+		// only the first item of ConvertJoin has no separator
+		if err := c.write(c.header); err != nil {
+			return err
+		}
+	}
+	if len(c.joinSep) > 0 {
+		if err := c.write(c.joinSep); err != nil {
+			return err
+		}
+	}
+	if c.resume {
+		// the prefix and the opening delimiter were already written
+		c.state.bomChecked = true
+		c.state.verifyStart = len(c.state.verifyOut)
+		return nil
+	}
 
-	for {
-		if processed+utf8.UTFMax > bufSize {
-			// need to read more
-			leftover := bufSize - processed
-			if leftover > 0 {
-				copy(c.readBuffer[:leftover], c.readBuffer[processed:])
+	if len(c.prefix) > 0 {
+		if err := c.write(c.prefix); err != nil {
+			return err
+		}
+		c.state.column = len(c.prefix)
+	}
+	if c.quotes {
+		if err := c.write(c.open); err != nil {
+			return err
+		}
+		c.state.column += len(c.open)
+	}
+	c.state.verifyStart = len(c.state.verifyOut)
+	return nil
+}
+
+// inUse reports whether a conversion is in progress,
+// between begin and end.
+func (c *Quoter) inUse() bool {
+	return c.out != nil
+}
+
+// end finishes the conversion started by begin.
+// err is the error that stopped the conversion, if any.
+func (c *Quoter) end(err error) (Stats, error) {
+	if c.out == nil {
+		return Stats{}, err
+	}
+	if c.quotes && err == nil {
+		err = c.write(c.close)
+	}
+	if c.verify && err == nil {
+		// before the ellipsis, which isn't part of the literal
+		err = c.verifyGoLiteral()
+	}
+	if c.state.truncated && err == nil {
+		err = c.write(c.ellipsis)
+	}
+	if len(c.suffix) > 0 && err == nil {
+		err = c.write(c.suffix)
+	}
+	if c.trailingNewline && err == nil {
+		err = c.write(newline)
+	}
+	if !c.joining || err != nil {
+		// ConvertJoin flushes once, after the last item
+		if flushErr := c.flush(); err == nil {
+			err = flushErr
+		}
+		if f, ok := c.out.(flusher); ok && c.autoFlush && err == nil {
+			err = f.Flush()
+		}
+	}
+	c.totalWritten += int64(c.state.stats.BytesWritten)
+	c.reportProgress()
+	c.out = nil
+	return c.state.stats, err
+}
+
+// reportProgress calls the callback set by WithProgress, if any.
+func (c *Quoter) reportProgress() {
+	if c.progress != nil {
+		c.progress(c.state.consumed, c.state.stats.BytesWritten)
+	}
+}
+
+// convertData converts the runes in data, and returns the number of
+// bytes converted. If final is false, it stops before an incomplete
+// rune at the end of data, so that it can be completed by the next call.
+// Otherwise the incomplete rune is treated as invalid UTF-8.
+func (c *Quoter) convertData(data []byte, final bool) (int, error) {
+	processed, err := c.convertUTF8(data, final)
+	if c.verify {
+		c.state.verifyIn = append(c.state.verifyIn, data[:processed]...)
+	}
+	return processed, err
+}
+
+// convertFinal converts data, the end of the input, like convertData.
+// With WithStrictTrailing, an incomplete rune at the end is not converted,
+// and an error wrapping ErrUnexpectedEOF is returned instead.
+func (c *Quoter) convertFinal(data []byte) (int, error) {
+	incomplete := 0
+	if c.strictTrailing && !c.byteSlice && !c.bytewise() {
+		incomplete = incompleteRune(data)
+	}
+	processed, err := c.convertData(data[:len(data)-incomplete], true)
+	if err == nil && incomplete > 0 {
+		err = fmt.Errorf("%w: incomplete rune %q at offset %d", ErrUnexpectedEOF, data[processed:], c.state.consumed)
+	}
+	return processed, err
+}
+
+// convertUTF8 does the work of convertData.
+func (c *Quoter) convertUTF8(data []byte, final bool) (int, error) {
+	if c.byteSlice {
+		return c.convertByteSlice(data)
+	}
+	if c.bytewise() {
+		return c.convertBytewise(data)
+	}
+	processed := 0
+	if c.stripBOM && !c.state.bomChecked {
+		if !final && len(data) < len(bom) && bytes.HasPrefix(bom, data) {
+			// not enough data to tell yet
+			return 0, nil
+		}
+		c.state.bomChecked = true
+		if bytes.HasPrefix(data, bom) {
+			processed = len(bom)
+			c.state.consumed += len(bom)
+		}
+	}
+	for processed < len(data) {
+		if c.limitRunes && c.state.stats.RunesTotal >= c.maxRunes {
+			break
+		}
+		rest := data[processed:]
+		if c.safe[rest[0]] && c.plainRunes {
+			// fast path for runs of printable ASCII
+			run := asciiRun(rest, c.maxRun(), &c.safe)
+			if run > 0 {
+				c.state.invalid = false
+				if err := c.write(rest[:run]); err != nil {
+					return processed, err
+				}
+				processed += run
+				c.state.consumed += run
+				c.state.stats.RunesTotal += run
+				continue
+			}
+		}
+		if c.escapes != nil && c.escapes[rest[0]] != nil {
+			// fast path for runs of bytes that are escaped
+			run, err := c.escapeBytes(rest)
+			if err != nil {
+				return processed, err
+			}
+			if run > 0 {
+				processed += run
+				continue
+			}
+		}
+		if !final && len(rest) < utf8.UTFMax && !utf8.FullRune(rest) {
+			break
+		}
+		if !final && len(rest) == 1 && rest[0] == 0 && c.nulShortForm {
+			// the next byte decides how NUL is escaped
+			break
+		}
+		if c.normalizeNewlines && rest[0] == '\r' {
+			if !final && len(rest) == 1 {
+				// the next byte decides whether \r is dropped
+				break
 			}
-			read, peekErr := in.Read(c.readBuffer[leftover:])
-			if peekErr != nil && peekErr != io.EOF {
-				err = peekErr
+			if len(rest) > 1 && rest[1] == '\n' {
+				processed++
+				c.state.consumed++
+				c.state.stats.RunesTotal++
+				continue
+			}
+		}
+
+		if c.templateSafe && rest[0] == '{' {
+			if !final && len(rest) == 1 {
+				// the next byte decides whether it starts a template action
 				break
 			}
-			dataLen = leftover + read
-			processed = 0
+			if len(rest) > 1 && rest[1] == '{' {
+				if err := c.writeWrapped(templateBrace); err != nil {
+					return processed, err
+				}
+				c.state.invalid = false
+				processed++
+				c.state.consumed++
+				c.state.stats.RunesTotal++
+				c.state.stats.RunesEscaped++
+				continue
+			}
+		}
+
+		var escaped []byte
+		r, width := utf8.DecodeRune(rest)
+		wasInvalid := c.state.invalid
+		c.state.invalid = width == 1 && r == utf8.RuneError
+		if c.state.invalid {
+			if c.strictUTF8 {
+				return processed, &InvalidUTF8Error{Offset: c.state.consumed}
+			}
+			switch c.invalidUTF8 {
+			case ReplacementChar:
+				if !wasInvalid {
+					escaped = c.convertReplacement()
+				}
+			case Drop:
+			default:
+				if c.invalidReplacement != nil {
+					escaped = c.invalidReplacement
+				} else if c.escaper != nil {
+					escaped = c.escaper.Escape(c.writeBuffer[:0], utf8.RuneError, rest[:1])
+				} else {
+					escaped = appendInvalidByte(c.writeBuffer[:0], rest[0], &c.style)
+				}
+			}
+			c.state.stats.InvalidBytes++
+		} else if r == '\t' && c.tabWidth > 0 {
+			var err error
+			if escaped, err = c.expandTab(); err != nil {
+				return processed, err
+			}
+		} else {
+			octalNext := len(rest) > 1 && isOctal(rune(rest[1]))
+			escaped = c.convertRune(r, rest[:width], octalNext)
+		}
+		if err := c.writeWrapped(escaped); err != nil {
+			return processed, err
+		}
+		processed += width
+		c.state.consumed += width
+		c.state.stats.RunesTotal++
+	}
+	return processed, nil
+}
+
+// escapeTable holds the escape sequences of ASCII bytes, and of the
+// bytes that are invalid UTF-8 wherever they are.
+type escapeTable [256][]byte
+
+// newEscapeTable returns the escape sequences of the ASCII bytes that are
+// always escaped the same way with the configuration of c, and of the
+// bytes that are invalid wherever they are, unless invalid UTF-8 is
+// replaced, dropped or rejected. It returns nil if the table can't be used.
+// The other bytes have no entry.
+func (c *Quoter) newEscapeTable() *escapeTable {
+	// WithValidateOutput checks each escape sequence in writeWrapped,
+	// which the table bypasses, and the escape sequences of a run are
+	// written at once, so they can't be wrapped, padded or made messages
+	if c.escaper != nil || c.byteSlice || c.bytewise() || c.validateOutput ||
+		!c.plainRunes || c.messages {
+		return nil
+	}
+	var t escapeTable
+	for b := 0; b < utf8.RuneSelf; b++ {
+		switch {
+		case c.safe[b]:
+		case b == 0 && c.nulShortForm:
+			// depends on the next byte
+		case b == '\r' && c.normalizeNewlines:
+			// depends on the next byte
+		case b == '\t' && c.tabWidth > 0:
+			// depends on the column
+		default:
+			raw := []byte{byte(b)}
+			escaped := c.convertRune(rune(b), raw, false)
+			if len(escaped) > 0 && !bytes.Equal(escaped, raw) {
+				t[b] = append([]byte(nil), escaped...)
+			}
+		}
+	}
+	if c.invalidUTF8 == EscapeHex && c.invalidReplacement == nil && !c.strictUTF8 {
+		for b := utf8.RuneSelf; b < len(t); b++ {
+			if b < 0xc2 || b > 0xf4 {
+				// continuation bytes, and bytes that never start a rune
+				t[b] = appendInvalidByte(nil, byte(b), &c.style)
+			}
 		}
-		if dataLen-processed == 0 {
+	}
+	return &t
+}
+
+// escapeBytes converts the run of bytes at the start of data that
+// have an entry in the escape table, collecting their escape sequences
+// in the output buffer, or in the escape buffer before writing them if
+// write has more to do, and returns the number of bytes converted.
+// It converts nothing if the first escape sequence doesn't fit in the
+// output buffer or under the limits.
+func (c *Quoter) escapeBytes(data []byte) (int, error) {
+	max := c.maxRun()
+	buf := c.outBuffer[len(c.outBuffer):]
+	if !c.state.plainWrites {
+		if max > len(c.escapeBuffer) {
+			max = len(c.escapeBuffer)
+		}
+		buf = c.escapeBuffer[:0]
+	}
+	n, invalid := 0, 0
+	for ; n < len(data); n++ {
+		escaped := c.escapes[data[n]]
+		if escaped == nil || len(buf)+len(escaped) > max {
 			break
 		}
+		if data[n] >= utf8.RuneSelf {
+			invalid++
+		}
+		buf = append(buf, escaped...)
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	var err error
+	if c.state.plainWrites {
+		// collected in place, maxRun kept it within the output buffer
+		c.outBuffer = c.outBuffer[:len(c.outBuffer)+len(buf)]
+		err = c.buffered(len(buf))
+	} else {
+		err = c.write(buf)
+	}
+	if err != nil {
+		return 0, err
+	}
+	c.state.invalid = data[n-1] >= utf8.RuneSelf
+	c.state.consumed += n
+	c.state.stats.RunesTotal += n
+	c.state.stats.RunesEscaped += n - invalid
+	c.state.stats.InvalidBytes += invalid
+	return n, nil
+}
 
-		maxRune := processed + utf8.UTFMax
-		if maxRune > dataLen {
-			maxRune = dataLen
+// convertRune returns the converted form of the valid rune r, which is
+// either in the write buffer, or raw, the UTF-8 encoding of r.
+// octalNext reports whether r is followed by an octal digit.
+func (c *Quoter) convertRune(r rune, raw []byte, octalNext bool) []byte {
+	if c.escaper != nil {
+		escaped := c.escaper.Escape(c.writeBuffer[:0], r, raw)
+		if !bytes.Equal(escaped, raw) {
+			c.state.stats.RunesEscaped++
+		}
+		return escaped
+	}
+	if c.replacements != nil {
+		if repl := c.replacement(r); repl != nil {
+			c.state.stats.RunesEscaped++
+			return repl
+		}
+	}
+	var escaped []byte
+	switch {
+	case c.style.csv:
+		if r != '"' {
+			return raw
 		}
-		data := c.readBuffer[processed:maxRune]
+		escaped = append(c.writeBuffer[:0], '"', '"')
+	case c.html && r < rune(len(htmlEntities)) && htmlEntities[r] != "":
+		escaped = append(c.writeBuffer[:0], htmlEntities[r]...)
+	case r == 0 && c.nulShortForm && !octalNext:
+		escaped = append(c.writeBuffer[:0], '\\', '0')
+	case c.isAlwaysEscaped(r):
+		escaped = appendRune(append(c.writeBuffer[:0], '\\'), r)
+	case c.needsEscape(r):
+		if c.classifier != nil && r != c.delimiter && r != '\\' {
+			// it may have been rejected even though it's printable
+			escaped = appendEscape(c.writeBuffer[:0], r, &c.style)
+		} else {
+			escaped = appendEscapedRune(c.writeBuffer[:0], r, c.delimiter, c.ascii, &c.style)
+		}
+	default:
+		return raw
+	}
+	c.state.stats.RunesEscaped++
+	return escaped
+}
+
+// convertReplacement returns the converted form of the replacement
+// character, which is written for invalid input with ReplacementChar.
+func (c *Quoter) convertReplacement() []byte {
+	if c.invalidReplacement != nil {
+		return c.invalidReplacement
+	}
+	if c.escaper != nil {
+		width := utf8.EncodeRune(c.runeBuffer[:], utf8.RuneError)
+		return c.escaper.Escape(c.writeBuffer[:0], utf8.RuneError, c.runeBuffer[:width])
+	}
+	return appendEscapedRune(c.writeBuffer[:0], utf8.RuneError, c.delimiter, c.ascii, &c.style)
+}
 
-		var discard, n2 int
-		r, width := utf8.DecodeRune(data)
-		if width == 1 && r == utf8.RuneError {
-			c.writeBuffer[0] = '\\'
-			c.writeBuffer[1] = 'x'
-			c.writeBuffer[2] = lowerhex[data[0]>>4]
-			c.writeBuffer[3] = lowerhex[data[0]&0xF]
-			out.Write(c.writeBuffer[0:4])
-			n2 = 4
-			discard = 1
+// isOctal reports whether r is an octal digit.
+func isOctal(r rune) bool {
+	return r >= '0' && r <= '7'
+}
+
+// convertRunes converts the runes in src.
+func (c *Quoter) convertRunes(src []rune) error {
+	raw := &c.runeBuffer
+	for i, r := range src {
+		width := utf8.EncodeRune(raw[:], r)
+		if c.verify {
+			// like convertData, everything is part of the input
+			c.state.verifyIn = append(c.state.verifyIn, raw[:width]...)
+		}
+		if c.byteSlice {
+			if _, err := c.convertByteSlice(raw[:width]); err != nil {
+				return err
+			}
+			continue
+		}
+		if c.bytewise() {
+			if _, err := c.convertBytewise(raw[:width]); err != nil {
+				return err
+			}
+			continue
+		}
+		c.state.consumed += width
+		if i == 0 && c.stripBOM && r == 0xFEFF {
+			continue
+		}
+		if c.normalizeNewlines && r == '\r' && i+1 < len(src) && src[i+1] == '\n' {
+			c.state.stats.RunesTotal++
+			continue
+		}
+		var escaped []byte
+		if r == '\t' && c.tabWidth > 0 {
+			var err error
+			if escaped, err = c.expandTab(); err != nil {
+				return err
+			}
+		} else if c.templateSafe && r == '{' && i+1 < len(src) && src[i+1] == '{' {
+			escaped = templateBrace
+			c.state.stats.RunesEscaped++
+		} else if utf8.ValidRune(r) {
+			octalNext := i+1 < len(src) && isOctal(src[i+1])
+			escaped = c.convertRune(r, raw[:width], octalNext)
 		} else {
-			discard = width
-			if r == rune('"') || r == '\\' { // always backslashed
-				c.writeBuffer[0] = '\\'
-				c.writeBuffer[1] = byte(r)
-				out.Write(c.writeBuffer[0:2])
-				n2 = 2
-			} else if strconv.IsPrint(r) {
-				out.Write(data[:width])
-				n2 = width
-			} else {
-				switch r {
-				case '\a':
-					c.writeBuffer[0] = '\\'
-					c.writeBuffer[1] = 'a'
-					out.Write(c.writeBuffer[0:2])
-					n2 = 2
-				case '\b':
-					c.writeBuffer[0] = '\\'
-					c.writeBuffer[1] = 'b'
-					out.Write(c.writeBuffer[0:2])
-					n2 = 2
-				case '\f':
-					c.writeBuffer[0] = '\\'
-					c.writeBuffer[1] = 'f'
-					out.Write(c.writeBuffer[0:2])
-					n2 = 2
-				case '\n':
-					c.writeBuffer[0] = '\\'
-					c.writeBuffer[1] = 'n'
-					out.Write(c.writeBuffer[0:2])
-					n2 = 2
-				case '\r':
-					c.writeBuffer[0] = '\\'
-					c.writeBuffer[1] = 'r'
-					out.Write(c.writeBuffer[0:2])
-					n2 = 2
-				case '\t':
-					c.writeBuffer[0] = '\\'
-					c.writeBuffer[1] = 't'
-					out.Write(c.writeBuffer[0:2])
-					n2 = 2
-				case '\v':
-					c.writeBuffer[0] = '\\'
-					c.writeBuffer[1] = 'v'
-					out.Write(c.writeBuffer[0:2])
-					n2 = 2
-				default:
-					switch {
-					case r < ' ' || r == 0x7f:
-						c.writeBuffer[0] = '\\'
-						c.writeBuffer[1] = 'x'
-						c.writeBuffer[2] = lowerhex[data[0]>>4]
-						c.writeBuffer[3] = lowerhex[data[0]&0xF]
-						out.Write(c.writeBuffer[0:4])
-						n2 = 4
-					case r > utf8.MaxRune:
-						r = 0xFFFD
-						fallthrough
-					case r < 0x10000:
-						c.writeBuffer[0] = '\\'
-						c.writeBuffer[1] = 'u'
-						n2 = 2
-						i := 2
-						for s := 12; s >= 0; s -= 4 {
-							c.writeBuffer[i] = lowerhex[r>>uint(s)&0xF]
-							i++
-							n2++
-						}
-						out.Write(c.writeBuffer[0:i])
-					default:
-						c.writeBuffer[0] = '\\'
-						c.writeBuffer[1] = 'U'
-						n2 = 2
-						i := 2
-						for s := 28; s >= 0; s -= 4 {
-							c.writeBuffer[i] = lowerhex[r>>uint(s)&0xF]
-							i++
-							n2++
-						}
-						out.Write(c.writeBuffer[0:i])
-					}
+			switch {
+			case c.escaper != nil:
+				escaped = c.convertReplacement()
+			case c.escapeSurrogates && utf16.IsSurrogate(r) && !c.style.csv:
+				escaped = appendUEscape(c.writeBuffer[:0], r, &c.style)
+			case c.invalidReplacement != nil:
+				escaped = c.invalidReplacement
+			default:
+				escaped = appendInvalidRune(c.writeBuffer[:0], &c.style)
+			}
+			c.state.stats.RunesEscaped++
+		}
+		if err := c.writeWrapped(escaped); err != nil {
+			return err
+		}
+		c.state.stats.RunesTotal++
+	}
+	return nil
+}
+
+// maxRun returns the maximum number of bytes that can be written
+// without exceeding the output limit or overflowing the output buffer.
+func (c *Quoter) maxRun() int {
+	max := c.outSize - len(c.outBuffer)
+	if c.maxOutput > 0 {
+		remaining := c.maxOutput - int64(c.state.stats.BytesWritten)
+		if remaining < int64(max) {
+			max = int(remaining)
+		}
+	}
+	if c.limitRunes {
+		if remaining := c.maxRunes - c.state.stats.RunesTotal; remaining < max {
+			max = remaining
+		}
+	}
+	if c.rotate != nil {
+		remaining := c.rotateSize - c.state.fileWritten
+		if remaining < 0 {
+			remaining = 0
+		}
+		if remaining < int64(max) {
+			max = int(remaining)
+		}
+	}
+	return max
+}
+
+// needsEscape reports whether r has to be escaped.
+func (c *Quoter) needsEscape(r rune) bool {
+	return r == c.delimiter || r == '\\' || !c.IsPrintable(r)
+}
+
+// replacement is a rune and the bytes written in its place.
+type replacement struct {
+	r    rune
+	repl []byte
+}
+
+// replacement returns the replacement of r set by WithReplacement,
+// or nil if there isn't one.
+func (c *Quoter) replacement(r rune) []byte {
+	for i := len(c.replacements) - 1; i >= 0; i-- {
+		if c.replacements[i].r == r {
+			return c.replacements[i].repl
+		}
+	}
+	return nil
+}
+
+// isAlwaysEscaped reports whether r was added by WithAlwaysEscape.
+func (c *Quoter) isAlwaysEscaped(r rune) bool {
+	for _, e := range c.alwaysEscape {
+		if r == e {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPrintable reports whether r is printable according to
+// the configuration of c.
+func (c *Quoter) IsPrintable(r rune) bool {
+	if c.literalWhitespace && (r == '\n' || r == '\r' || r == '\t') {
+		return true
+	}
+	if c.style.js && (r == '\u2028' || r == '\u2029') {
+		return false
+	}
+	if c.style.csv {
+		return utf8.ValidRune(r)
+	}
+	if c.classifier != nil {
+		return utf8.ValidRune(r) && !isControl(r) && c.classifier(r)
+	}
+	if c.graphic {
+		return strconv.IsGraphic(r)
+	}
+	if c.minimal {
+		return utf8.ValidRune(r) && !isControl(r)
+	}
+	return isPrint(r, c.ascii)
+}
+
+// MaxExpansionFactor returns the maximum number of bytes written for each
+// byte of input with the configuration of c, not counting the bytes written
+// once per conversion, like the quotes, WithPrefix and WithSuffix.
+// n bytes of input are converted to at most n*MaxExpansionFactor() bytes,
+// plus those. It's an upper bound, most input expands much less, and
+// with WithLineWrap it assumes the worst, that a continuation is written
+// after every rune. It returns 0 if WithEscaper is used, because then
+// it's not known.
+func (c *Quoter) MaxExpansionFactor() int {
+	if c.escaper != nil {
+		return 0
+	}
+	var factor int
+	switch {
+	case c.byteSlice:
+		factor = len(" 0x00,")
+	case c.percent:
+		factor = len("%00")
+	case c.byteRanges != nil:
+		factor = len(`\x00`)
+	case c.style.csv:
+		// a double quote is doubled
+		factor = 2
+		if c.invalidUTF8 == ReplacementChar {
+			factor = utf8.RuneLen(utf8.RuneError)
+		}
+	case c.style.python || c.style.js:
+		// invalid bytes are \udcHH or \ufffd
+		factor = len(`\u0000`)
+	case c.invalidUTF8 == ReplacementChar && c.ascii:
+		factor = len(`\ufffd`)
+	default:
+		// invalid bytes and C0 controls are \xHH
+		factor = len(`\x00`)
+	}
+	if c.html && factor < len("&amp;") {
+		factor = len("&amp;")
+	}
+	// the other options don't apply to the modes that convert bytes
+	text := !c.byteSlice && !c.bytewise()
+	if len(c.invalidReplacement) > factor && text {
+		factor = len(c.invalidReplacement)
+	}
+	if c.classifier != nil && text && factor < len(`\u0000`) {
+		// a rejected ASCII rune is \u00HH, that's the most,
+		// longer escapes are for runes of 3 or 4 bytes
+		factor = len(`\u0000`)
+	}
+	if c.tabWidth > factor && text {
+		// a tab is up to tabWidth spaces
+		factor = c.tabWidth
+	}
+	if c.templateSafe && text && factor < len(templateBrace) {
+		factor = len(templateBrace)
+	}
+	for r, escape := range c.style.short {
+		width := utf8.RuneLen(r)
+		if width < 0 || !text {
+			continue
+		}
+		if f := (len(escape) + width - 1) / width; f > factor {
+			factor = f
+		}
+	}
+	for _, rep := range c.replacements {
+		width := utf8.RuneLen(rep.r)
+		if width < 0 {
+			continue
+		}
+		if f := (len(rep.repl) + width - 1) / width; f > factor {
+			factor = f
+		}
+	}
+	if c.fixedWidth > 0 {
+		// the padding adds at most fixedWidth bytes per input byte
+		factor += c.fixedWidth
+	}
+	if c.wrapCols > 0 {
+		factor += len(c.continuation)
+	}
+	return factor
+}
+
+// convertByteSlice writes the bytes in data as
+// the elements of a Go byte slice literal.
+func (c *Quoter) convertByteSlice(data []byte) (int, error) {
+	for i, b := range data {
+		element := c.writeBuffer[:0]
+		if c.state.consumed > 0 {
+			element = append(element, ' ')
+		}
+		element = append(element, '0', 'x', c.style.hex[b>>4], c.style.hex[b&0xF], ',')
+		if err := c.writeWrapped(element); err != nil {
+			return i, err
+		}
+		c.state.consumed++
+	}
+	return len(data), nil
+}
+
+// bytewise reports whether the input is converted byte by byte,
+// with WithPercentEncoding or WithByteRanges.
+func (c *Quoter) bytewise() bool {
+	return c.percent || c.byteRanges != nil
+}
+
+// convertBytewise writes the bytes in data that are safe as they are,
+// and the others percent-encoded, or as \xHH with WithByteRanges.
+func (c *Quoter) convertBytewise(data []byte) (int, error) {
+	processed := 0
+	for processed < len(data) {
+		rest := data[processed:]
+		b := rest[0]
+		width := 1
+		var encoded []byte
+		if c.safe[b] {
+			if c.wrapCols == 0 && c.fixedWidth == 0 {
+				if run := asciiRun(rest, c.maxRun(), &c.safe); run > 0 {
+					width = run
 				}
 			}
+			encoded = rest[:width]
+		} else if c.percent {
+			encoded = append(c.writeBuffer[:0], '%', upperhex[b>>4], upperhex[b&0xF])
+		} else {
+			encoded = appendEscapedByte(c.writeBuffer[:0], b, c.style.hex)
+		}
+		if err := c.writeWrapped(encoded); err != nil {
+			return processed, err
+		}
+		processed += width
+		c.state.consumed += width
+	}
+	return processed, nil
+}
+
+// expandTab returns the spaces that move the output to the next tab stop.
+// If they don't fit on the current line, the line is wrapped first.
+func (c *Quoter) expandTab() ([]byte, error) {
+	n := c.tabWidth - c.state.tabColumn%c.tabWidth
+	if c.wrapCols > 0 && c.state.column > 0 && c.state.column+n > c.wrapCols {
+		if err := c.write(c.continuation); err != nil {
+			return nil, err
+		}
+		c.state.column = 0
+		n = c.tabWidth - c.state.tabColumn%c.tabWidth
+	}
+	c.state.stats.RunesEscaped++
+	return c.tabSpaces[:n], nil
+}
+
+// writeWrapped writes p, preceded by the continuation
+// if it doesn't fit on the current line,
+// and followed by the padding of WithFixedWidth.
+func (c *Quoter) writeWrapped(p []byte) error {
+	if c.plainRunes && !c.validateOutput {
+		return c.write(p)
+	}
+	if c.validateOutput && !utf8.Valid(p) {
+		return fmt.Errorf("%w: %q for the input at offset %d", ErrInvalidOutput, p, c.state.consumed)
+	}
+	pad := 0
+	if c.fixedWidth > 0 && len(p) > 0 {
+		cols := utf8.RuneCount(p)
+		if cols > c.fixedWidth {
+			return fmt.Errorf("%w: %q is %d columns wide for the input at offset %d", ErrTooWide, p, cols, c.state.consumed)
+		}
+		pad = c.fixedWidth - cols
+	}
+	if c.wrapCols > 0 {
+		if c.state.column > 0 && c.state.column+len(p)+pad > c.wrapCols {
+			if err := c.write(c.continuation); err != nil {
+				return err
+			}
+			c.state.column = 0
+		}
+		c.state.column += len(p) + pad
+		if len(p) == 1 && p[0] == '\n' {
+			// literal newline
+			c.state.column = pad
+		}
+	}
+	if err := c.write(p); err != nil {
+		return err
+	}
+	if pad > 0 {
+		return c.write(c.fixedPad[:pad])
+	}
+	return nil
+}
+
+// Clone returns a new Quoter with the same configuration,
+// but its own buffers, so it can be used concurrently with c.
+// If c uses WithHash, the conversions of the clone fail with an error
+// wrapping ErrSharedHash instead of writing to the same hash.
+func (c *Quoter) Clone() *Quoter {
+	clone := *c
+	if c.readBuffer != nil {
+		clone.readBuffer = make([]byte, len(c.readBuffer))
+	}
+	clone.outBuffer = nil
+	clone.out = nil
+	clone.state = conversionState{}
+	clone.totalWritten = 0
+	if c.hash != nil {
+		clone.hash = nil
+		clone.setErr(ErrSharedHash)
+	}
+	return &clone
+}
+
+// TotalWritten returns the number of bytes written by all conversions
+// since the converter was created or last reset, including the bytes
+// written by conversions that failed.
+func (c *Quoter) TotalWritten() int64 {
+	return c.totalWritten
+}
+
+// BufferStats returns statistics about how the read buffer was used by
+// the last conversion. They are zero for ConvertBytes and ConvertRunes,
+// which don't use the read buffer.
+func (c *Quoter) BufferStats() BufferStats {
+	return c.state.buffer
+}
+
+// Reset sets the count returned by TotalWritten to zero.
+func (c *Quoter) Reset() {
+	c.totalWritten = 0
+}
+
+// LastPosition returns the position after the output of the last
+// conversion, if WithColumnTracking is used. Both line and col start
+// at 1, and col is counted in bytes.
+func (c *Quoter) LastPosition() (line, col int) {
+	if !c.trackPosition {
+		return 0, 0
+	}
+	return c.state.lines + 1, c.state.lastLineLen + 1
+}
+
+// rotateIfFull switches to the next writer returned by rotate,
+// if n more bytes wouldn't fit in the current one.
+// Something is always written to each writer, even if it doesn't fit.
+func (c *Quoter) rotateIfFull(n int) error {
+	if c.state.fileWritten > 0 && c.state.fileWritten+int64(n) > c.rotateSize {
+		if err := c.flush(); err != nil {
+			return err
+		}
+		out, err := c.rotate()
+		if err != nil {
+			return err
+		}
+		c.out = out
+		c.state.fileWritten = 0
+	}
+	c.state.fileWritten += int64(n)
+	return nil
+}
+
+// flusher is implemented by buffered writers like bufio.Writer.
+type flusher interface {
+	Flush() error
+}
+
+// MessageWriter is implemented by writers of message-oriented transports.
+// With WithMessageBoundaries, Convert calls WriteMessage instead of Write,
+// with each message. WriteMessage must not modify or retain the slice.
+type MessageWriter interface {
+	WriteMessage(p []byte) error
+}
+
+// write adds p to the output buffer, enforcing the output limit,
+// and flushes the buffer once it's full.
+func (c *Quoter) write(p []byte) error {
+	if c.state.plainWrites {
+		c.outBuffer = append(c.outBuffer, p...)
+		return c.buffered(len(p))
+	}
+	stats := &c.state.stats
+	if c.maxOutput > 0 && int64(stats.BytesWritten+len(p)) > c.maxOutput {
+		return ErrOutputTooLarge
+	}
+	if c.rotate != nil {
+		if err := c.rotateIfFull(len(p)); err != nil {
+			return err
+		}
+	}
+	c.outBuffer = append(c.outBuffer, p...)
+	stats.BytesWritten += len(p)
+	if c.verify {
+		c.state.verifyOut = append(c.state.verifyOut, p...)
+	}
+	if c.tabWidth > 0 {
+		if i := bytes.LastIndexByte(p, '\n'); i >= 0 {
+			c.state.tabColumn = utf8.RuneCount(p[i+1:])
+		} else {
+			c.state.tabColumn += utf8.RuneCount(p)
+		}
+	}
+	if c.trackPosition {
+		if i := bytes.LastIndexByte(p, '\n'); i >= 0 {
+			c.state.lines += bytes.Count(p[:i], newline) + 1
+			c.state.lastLineLen = len(p) - i - 1
+		} else {
+			c.state.lastLineLen += len(p)
+		}
+	}
+	if _, ok := c.out.(MessageWriter); ok && c.messages {
+		// each write is a message
+		return c.flush()
+	}
+	if len(c.outBuffer) >= c.outSize {
+		return c.flushAligned()
+	}
+	return nil
+}
+
+// buffered counts the n bytes added to the end of the output buffer,
+// and flushes the buffer once it's full.
+func (c *Quoter) buffered(n int) error {
+	c.state.stats.BytesWritten += n
+	if len(c.outBuffer) >= c.outSize {
+		return c.flushAligned()
+	}
+	return nil
+}
+
+// flush writes the output buffer to the writer.
+func (c *Quoter) flush() error {
+	return c.flushPrefix(len(c.outBuffer))
+}
+
+// flushAligned writes the output buffer to the writer, holding back the
+// bytes after the last multiple of the alignment of WithFlushAlignment.
+func (c *Quoter) flushAligned() error {
+	n := len(c.outBuffer)
+	if c.flushAlign > 0 {
+		n -= n % c.flushAlign
+	}
+	return c.flushPrefix(n)
+}
+
+// flushPrefix writes the first n bytes of the output buffer to the writer,
+// and keeps the rest in the buffer. If the write fails, the whole buffer
+// is discarded, and the bytes that weren't written are subtracted from
+// the written byte count.
+func (c *Quoter) flushPrefix(n int) error {
+	if n == 0 {
+		return nil
+	}
+	buffered := len(c.outBuffer)
+	chunk := c.outBuffer[:n]
+	var written int
+	var err error
+	if c.framed {
+		err = c.writeFrameHeader(n)
+	}
+	if err == nil {
+		written, err = c.writeOut(chunk)
+	}
+	if written < 0 || written > n {
+		// like io.Copy, don't trust any of it
+		written = 0
+		if err == nil {
+			err = ErrBadWriter
+		}
+	}
+	if c.hash != nil {
+		c.hash.Write(chunk[:written])
+	}
+	if err == nil && written < n {
+		err = ErrShortWrite
+	}
+	if err != nil {
+		c.state.stats.BytesWritten -= buffered - written
+		c.outBuffer = c.outBuffer[:0]
+		return err
+	}
+	c.outBuffer = c.outBuffer[:copy(c.outBuffer, c.outBuffer[n:])]
+	return nil
+}
+
+// writeFrameHeader writes the length of the next chunk of n bytes
+// to the writer, as a 4-byte big-endian integer.
+func (c *Quoter) writeFrameHeader(n int) error {
+	binary.BigEndian.PutUint32(c.frameHeader[:], uint32(n))
+	written, err := c.writeOut(c.frameHeader[:])
+	switch {
+	case err != nil:
+		return err
+	case written < 0 || written > len(c.frameHeader):
+		return ErrBadWriter
+	case written < len(c.frameHeader):
+		return ErrShortWrite
+	}
+	return nil
+}
+
+// writeOut writes p to the writer. If WithWriteInterrupt is used,
+// the write runs in its own goroutine, and writeOut stops waiting for it
+// when the context is done. In that case the output buffer is abandoned
+// to the pending write, and a new one is used from then on.
+func (c *Quoter) writeOut(p []byte) (int, error) {
+	if c.interrupt == nil {
+		return c.writeTo(c.out, p)
+	}
+	if err := c.interrupt.Err(); err != nil {
+		return 0, err
+	}
+	type result struct {
+		n   int
+		err error
+	}
+	out := c.out
+	done := make(chan result, 1)
+	go func() {
+		n, err := c.writeTo(out, p)
+		done <- result{n, err}
+	}()
+	select {
+	case r := <-done:
+		return r.n, r.err
+	case <-c.interrupt.Done():
+		c.outBuffer = nil
+		return 0, c.interrupt.Err()
+	}
+}
+
+// writeTo writes p to out, as a message with WithMessageBoundaries,
+// if out is a MessageWriter.
+func (c *Quoter) writeTo(out io.Writer, p []byte) (int, error) {
+	if mw, ok := out.(MessageWriter); ok && c.messages {
+		if err := mw.WriteMessage(p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	return out.Write(p)
+}
+
+// QuoteRune writes a single-quoted Go character literal representing
+// the rune to out, like strconv.QuoteRune.
+// If r is not a valid Unicode code point, it is interpreted as
+// the Unicode replacement character U+FFFD.
+func QuoteRune(r rune, out io.Writer) (int, error) {
+	if !utf8.ValidRune(r) {
+		r = utf8.RuneError
+	}
+	var buf [12]byte
+	b := append(buf[:0], '\'')
+	b = appendEscapedRune(b, r, '\'', false, &goStyle)
+	b = append(b, '\'')
+	return out.Write(b)
+}
+
+var quotePool = sync.Pool{
+	New: func() interface{} {
+		return New(WithQuotes())
+	},
+}
+
+// QuoteTo writes a double-quoted Go string literal representing s to out,
+// like fmt.Fprintf(out, "%q", s), without building the quoted string
+// in memory.
+func QuoteTo(out io.Writer, s string) (int, error) {
+	c := quotePool.Get().(*Quoter)
+	defer quotePool.Put(c)
+	return c.Convert(strings.NewReader(s), out)
+}
+
+var linePool = sync.Pool{
+	New: func() interface{} {
+		return New(WithQuotes(), WithTrailingNewline())
+	},
+}
+
+// ConvertLines writes each line of "in" to out as a double-quoted Go string
+// literal, like QuoteTo, followed by a newline. Lines end with a newline,
+// which is not part of the quoted line, so a carriage return before it is
+// escaped as \r. The last line doesn't need a newline, but if the input
+// ends with one, there is no empty line after it. Lines are converted
+// as they are read, so they can be of any length.
+func ConvertLines(in io.Reader, out io.Writer) (int, error) {
+	if in == nil {
+		return 0, ErrNilReader
+	}
+	c := linePool.Get().(*Quoter)
+	defer linePool.Put(c)
+	r := bufio.NewReader(in)
+	written := 0
+	for lines := 0; ; lines++ {
+		if _, err := r.Peek(1); err != nil {
+			if err == io.EOF {
+				return written, nil
+			}
+			return written, fmt.Errorf("streamquote: read error after %d lines: %w", lines, err)
+		}
+		n, err := c.Convert(&lineReader{r: r}, out)
+		written += n
+		if err != nil {
+			return written, err
 		}
-		processed += discard
-		n += n2
 	}
+}
 
-	return n, err
+// QuoteGo writes a Go string literal representing s to out. It writes s
+// unchanged as a raw string literal between backquotes if it can, and
+// a double-quoted string literal, like QuoteTo, otherwise.
+// A raw string literal can't contain backquotes. It is also not used if s
+// is not valid UTF-8, or contains control characters other than tab and
+// newline, or a byte order mark, since they are either not allowed in Go
+// source or would be changed, like carriage returns, which are removed
+// from raw string literals.
+func QuoteGo(s string, out io.Writer) (int, error) {
+	if !canRawQuote(s) {
+		return QuoteTo(out, s)
+	}
+	written := 0
+	for _, part := range [...]string{"`", s, "`"} {
+		n, err := io.WriteString(out, part)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// canRawQuote reports whether s can be written as a raw string literal.
+func canRawQuote(s string) bool {
+	for len(s) > 0 {
+		r, width := utf8.DecodeRuneInString(s)
+		s = s[width:]
+		switch {
+		case width == 1 && r == utf8.RuneError:
+			return false
+		case r == '`', r == '\uFEFF':
+			return false
+		case r < ' ' && r != '\t' && r != '\n', r == 0x7f:
+			return false
+		}
+	}
+	return true
+}
+
+// QuoteLogfmt writes s to out as a logfmt value. It writes s unchanged
+// if it's a clean token, and a double-quoted string literal, like QuoteTo,
+// if it's empty, or contains a space, an equals sign, a double quote,
+// or anything QuoteTo would escape, like control characters.
+func QuoteLogfmt(s string, out io.Writer) (int, error) {
+	if !isLogfmtToken(s) {
+		return QuoteTo(out, s)
+	}
+	return io.WriteString(out, s)
+}
+
+// isLogfmtToken reports whether s can be written as a logfmt value
+// without quotes.
+func isLogfmtToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for len(s) > 0 {
+		r, width := utf8.DecodeRuneInString(s)
+		s = s[width:]
+		switch {
+		case width == 1 && r == utf8.RuneError:
+			return false
+		case r == ' ', r == '=':
+			return false
+		case needsEscape(r, '"', false):
+			return false
+		}
+	}
+	return true
 }
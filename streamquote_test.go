@@ -2,12 +2,18 @@ package streamquote
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"unicode/utf8"
 )
 
 // Taken from stdlib's strconv/quote_test.go
@@ -43,6 +49,854 @@ func TestConverter(t *testing.T) {
 	}
 }
 
+// TestTruncatedUTF8 tests that incomplete UTF-8 sequences at the end
+// of the input are escaped the same way as strconv.Quote does it.
+func TestTruncatedUTF8(t *testing.T) {
+	converter := New()
+
+	for _, in := range []string{
+		"\xc2",
+		"\xe2\x82",
+		"\xf0\x9f\x98",
+		"abc\xc2",
+		"abc\xe2\x82",
+		"abc\xf0\x9f\x98",
+	} {
+		expected := strconv.Quote(in)
+		expected = expected[1 : len(expected)-1]
+		for _, r := range []io.Reader{
+			strings.NewReader(in),
+			iotest.OneByteReader(strings.NewReader(in)),
+		} {
+			var buffer bytes.Buffer
+			_, err := converter.Convert(r, &buffer)
+			if err != nil {
+				t.Fatalf("Converter failed: %v", err)
+			}
+			if out := buffer.String(); out != expected {
+				t.Errorf("Quote(%q) = %s, want %s", in, out, expected)
+			}
+		}
+	}
+}
+
+// TestBufferSizes tests the converter with read buffers
+// of various sizes, to catch errors at the buffer boundaries.
+func TestBufferSizes(t *testing.T) {
+	b, err := ioutil.ReadAll(io.LimitReader(generateLargeString(), 64*1024))
+	if err != nil {
+		t.Fatalf("Failed to read large string into buffer: %v", err)
+	}
+	inputs := []string{string(b)}
+	for _, tt := range quotetests {
+		inputs = append(inputs, tt.in)
+	}
+
+	for size := utf8.UTFMax; size <= 17; size++ {
+		converter := newConverter()
+		converter.readBuffer = make([]byte, size)
+		for _, in := range inputs {
+			expected := strconv.Quote(in)
+			expected = expected[1 : len(expected)-1]
+			var buffer bytes.Buffer
+			_, err := converter.Convert(strings.NewReader(in), &buffer)
+			if err != nil {
+				t.Fatalf("Converter failed: %v", err)
+			}
+			if out := buffer.String(); !testEqual(out, expected) {
+				t.Errorf("Buffer size %d: Quote(%q) = %s, want %s", size, in, out, expected)
+			}
+		}
+	}
+}
+
+// TestSmallBuffers tests the converter with read and output buffers
+// smaller than the longest escape sequence.
+func TestSmallBuffers(t *testing.T) {
+	in := "a\U0010ffff\x00\U0010fffe\u00ad\xffbc\U000fabcd"
+	expected := strconv.Quote(in)
+
+	for readSize := utf8.UTFMax; readSize <= 2*utf8.UTFMax; readSize++ {
+		for outSize := 1; outSize <= 12; outSize++ {
+			converter := newConverter(WithQuotes())
+			converter.readBuffer = make([]byte, readSize)
+			converter.outSize = outSize
+			var buffer bytes.Buffer
+			n, err := converter.Convert(strings.NewReader(in), &buffer)
+			if err != nil {
+				t.Fatalf("Converter failed: %v", err)
+			}
+			if out := buffer.String(); out != expected {
+				t.Errorf("Buffer sizes %d, %d: Quote(%q) = %s, want %s", readSize, outSize, in, out, expected)
+			}
+			if n != buffer.Len() {
+				t.Errorf("Buffer sizes %d, %d: returned %d, wrote %d bytes", readSize, outSize, n, buffer.Len())
+			}
+		}
+	}
+}
+
+// TestASCIIRuns tests long runs of printable ASCII
+// with occasional characters that need escaping.
+func TestASCIIRuns(t *testing.T) {
+	var b strings.Builder
+	for i := 0; i < 2000; i++ {
+		b.WriteString(strings.Repeat("x", i%37))
+		b.WriteString([]string{"\"", "\\", "\n", "\x00", "\u263a", "\xff", "\x7f"}[i%7])
+	}
+	in := b.String()
+	expected := strconv.Quote(in)
+	expected = expected[1 : len(expected)-1]
+
+	for _, size := range []int{utf8.UTFMax, 7, 64, 1000, DefaultBufferSize} {
+		converter := newConverter()
+		converter.readBuffer = make([]byte, size)
+		var buffer bytes.Buffer
+		n, err := converter.Convert(strings.NewReader(in), &buffer)
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if out := buffer.String(); !testEqual(out, expected) {
+			t.Errorf("Buffer size %d: output does not match", size)
+		}
+		if n != buffer.Len() {
+			t.Errorf("Buffer size %d: returned %d, wrote %d bytes", size, n, buffer.Len())
+		}
+	}
+}
+
+// TestShortReads tests that the converter keeps reading
+// from readers that return less data than requested.
+func TestShortReads(t *testing.T) {
+	converter := New()
+
+	for _, tt := range quotetests {
+		var buffer bytes.Buffer
+		converter.Convert(iotest.OneByteReader(strings.NewReader(tt.in)), &buffer)
+		expected := tt.out[1 : len(tt.out)-1]
+		if out := buffer.String(); !testEqual(out, expected) {
+			t.Errorf("Quote(%s) = %s, want %s", tt.in, out, expected)
+		}
+	}
+}
+
+func TestConvertStats(t *testing.T) {
+	converter := New()
+
+	tests := []struct {
+		in    string
+		stats Stats
+	}{
+		{"", Stats{}},
+		{"abc", Stats{RunesTotal: 3, BytesWritten: 3}},
+		{"a\"b\\c\n", Stats{RunesTotal: 6, RunesEscaped: 3, BytesWritten: 9}},
+		{"\u263a\u00a0", Stats{RunesTotal: 2, RunesEscaped: 1, BytesWritten: 9}},
+		{"abc\xff\xfedef", Stats{RunesTotal: 8, InvalidBytes: 2, BytesWritten: 14}},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		stats, err := converter.ConvertStats(strings.NewReader(tt.in), &buffer)
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if stats != tt.stats {
+			t.Errorf("ConvertStats(%q) = %+v, want %+v", tt.in, stats, tt.stats)
+		}
+		if stats.BytesWritten != buffer.Len() {
+			t.Errorf("ConvertStats(%q) reported %d bytes, wrote %d", tt.in, stats.BytesWritten, buffer.Len())
+		}
+	}
+}
+
+func TestConvertIfNeeded(t *testing.T) {
+	converter := New()
+
+	tests := []struct {
+		in      string
+		changed bool
+	}{
+		{"", false},
+		{"plain value ☺", false},
+		{"tab\tvalue", true},
+		{`"quoted"`, true},
+		{"abc\xff", true},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		n, changed, err := converter.ConvertIfNeeded(strings.NewReader(tt.in), &buffer)
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if changed != tt.changed {
+			t.Errorf("ConvertIfNeeded(%q) changed = %v, want %v", tt.in, changed, tt.changed)
+		}
+		if !changed && buffer.String() != tt.in {
+			t.Errorf("ConvertIfNeeded(%q) = %s, but reported no change", tt.in, buffer.String())
+		}
+		if n != buffer.Len() {
+			t.Errorf("ConvertIfNeeded(%q) returned %d, wrote %d bytes", tt.in, n, buffer.Len())
+		}
+	}
+}
+
+// TestRoundTrip tests that unquoting the converted data
+// reproduces the input exactly.
+func TestRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(randSeed))
+	pieces := []string{"a", " ", "\x00", "\x7f", "\x80", "\xff", "\xe2\x98", "\u00ad",
+		"\u263a", "\ufffd", "\U0001f600", "\U0010ffff", "\"", "\\", "\n", "'"}
+	converter := New(WithQuotes())
+	for i := 0; i < 1000; i++ {
+		var in []byte
+		for j := r.Intn(20); j > 0; j-- {
+			if r.Intn(2) == 0 {
+				in = append(in, byte(r.Intn(256)))
+			} else {
+				in = append(in, pieces[r.Intn(len(pieces))]...)
+			}
+		}
+		out, err := converter.ConvertAll(bytes.NewReader(in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		unquoted, err := strconv.Unquote(string(out))
+		if err != nil {
+			t.Fatalf("Unquote(%s) failed: %v", out, err)
+		}
+		if unquoted != string(in) {
+			t.Fatalf("Round trip of %q produced %q", in, unquoted)
+		}
+	}
+}
+
+func TestIsPrintable(t *testing.T) {
+	converter := New()
+	for r := rune(-1); r <= utf8.MaxRune+1; r++ {
+		if got, want := converter.IsPrintable(r), strconv.IsPrint(r); got != want {
+			t.Fatalf("IsPrintable(%U) = %v, want %v", r, got, want)
+		}
+	}
+}
+
+func TestDefaultBufferSize(t *testing.T) {
+	c := New()
+	if _, err := c.Convert(strings.NewReader("abc"), ioutil.Discard); err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if l := len(c.readBuffer); l != DefaultBufferSize {
+		t.Errorf("Expected buffer of %d bytes, got %d", DefaultBufferSize, l)
+	}
+}
+
+func TestClone(t *testing.T) {
+	converter := New(WithQuotes(), WithLineWrap(10, "\" +\n\""))
+	clone := converter.Clone()
+
+	in := strings.Repeat("abc\n\u263a\xff", 1000)
+	expected, err := converter.ConvertAll(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range []*Quoter{converter, clone} {
+		wg.Add(1)
+		go func(c *Quoter) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				out, err := c.ConvertAll(strings.NewReader(in))
+				if err != nil {
+					t.Errorf("Converter failed: %v", err)
+					return
+				}
+				if !bytes.Equal(out, expected) {
+					t.Errorf("Output of clone does not match")
+					return
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	// the hash can't be shared
+	h := sha256.New()
+	hashed := New(WithHash(h))
+	if _, err := hashed.Clone().Convert(strings.NewReader(in), ioutil.Discard); !errors.Is(err, ErrSharedHash) {
+		t.Errorf("Expected %v, got %v", ErrSharedHash, err)
+	}
+	if !bytes.Equal(h.Sum(nil), sha256.New().Sum(nil)) {
+		t.Errorf("The clone wrote to the hash of the original")
+	}
+	if _, err := hashed.Convert(strings.NewReader(in), ioutil.Discard); err != nil {
+		t.Errorf("Converter failed: %v", err)
+	}
+}
+
+var quoterunetests = []rune{
+	'a', '\a', '\\', '\'', '"', 0xFF, 0x263a, 0xdead, 0xfffd, 0xfffffff,
+	0x0010ffff, 0x0010ffff + 1, 0x04, 0x7f, 0xa0, 0x2000, 0x3000,
+	0x1F600, 0x1F468, 0x1F1ED, -1,
+}
+
+func TestQuoteRune(t *testing.T) {
+	for _, r := range quoterunetests {
+		var buffer bytes.Buffer
+		n, err := QuoteRune(r, &buffer)
+		if err != nil {
+			t.Fatalf("QuoteRune(%U) failed: %v", r, err)
+		}
+		expected := strconv.QuoteRune(r)
+		if out := buffer.String(); !testEqual(out, expected) {
+			t.Errorf("QuoteRune(%U) = %s, want %s", r, out, expected)
+		}
+		if n != buffer.Len() {
+			t.Errorf("QuoteRune(%U) returned %d, wrote %d bytes", r, n, buffer.Len())
+		}
+	}
+}
+
+func TestQuoteTo(t *testing.T) {
+	for _, tt := range quotetests {
+		var buffer bytes.Buffer
+		n, err := QuoteTo(&buffer, tt.in)
+		if err != nil {
+			t.Fatalf("QuoteTo failed: %v", err)
+		}
+		if out := buffer.String(); !testEqual(out, tt.out) {
+			t.Errorf("QuoteTo(%s) = %s, want %s", tt.in, out, tt.out)
+		}
+		if n != buffer.Len() {
+			t.Errorf("QuoteTo(%s) returned %d, wrote %d bytes", tt.in, n, buffer.Len())
+		}
+	}
+}
+
+func TestConvertRunes(t *testing.T) {
+	inputs := []string{"", "\x00", "\x001", "\ufeffa<b>$\ufeff", "\U0010ffff\u00ad\x7f"}
+	for _, tt := range quotetests {
+		inputs = append(inputs, tt.in)
+	}
+	optionSets := [][]Option{
+		nil,
+		{WithQuotes()},
+		{WithASCII(), WithLineWrap(5, "")},
+		{WithHTML(), WithNulShortForm(), WithAlwaysEscape('$')},
+		{WithStripBOM(), WithDelimiter('\'')},
+		{WithByteSlice()},
+	}
+	for _, opts := range optionSets {
+		converter := New(opts...)
+		for _, in := range inputs {
+			// []rune replaces invalid bytes with U+FFFD
+			runes := []rune(in)
+			expected, err := converter.ConvertAll(strings.NewReader(string(runes)))
+			if err != nil {
+				t.Fatalf("Converter failed: %v", err)
+			}
+			var buffer bytes.Buffer
+			n, err := converter.ConvertRunes(runes, &buffer)
+			if err != nil {
+				t.Fatalf("ConvertRunes failed: %v", err)
+			}
+			if out := buffer.Bytes(); !bytes.Equal(out, expected) {
+				t.Errorf("ConvertRunes(%q) = %s, want %s", in, out, expected)
+			}
+			if n != buffer.Len() {
+				t.Errorf("ConvertRunes(%q) returned %d, wrote %d bytes", in, n, buffer.Len())
+			}
+		}
+	}
+}
+
+func TestConvertRunesInvalid(t *testing.T) {
+	var buffer bytes.Buffer
+	_, err := New().ConvertRunes([]rune{'a', -1, 0xd800, utf8.MaxRune + 1, 'b'}, &buffer)
+	if err != nil {
+		t.Fatalf("ConvertRunes failed: %v", err)
+	}
+	if out, expected := buffer.String(), `a\ufffd\ufffd\ufffdb`; out != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+}
+
+func TestConvertRunesSurrogates(t *testing.T) {
+	tests := []struct {
+		r         rune
+		expected  string
+		surrogate string
+	}{
+		{0xd7ff, `\ud7ff`, `\ud7ff`},
+		{0xd800, `\ufffd`, `\ud800`},
+		{0xdbff, `\ufffd`, `\udbff`},
+		{0xdc00, `\ufffd`, `\udc00`},
+		{0xdfff, `\ufffd`, `\udfff`},
+		{0xe000, `\ue000`, `\ue000`},
+	}
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		New().ConvertRunes([]rune{tt.r}, &buffer)
+		if out := buffer.String(); out != tt.expected {
+			t.Errorf("ConvertRunes(%U) = %s, want %s", tt.r, out, tt.expected)
+		}
+		buffer.Reset()
+		New(WithEscapeSurrogates()).ConvertRunes([]rune{tt.r}, &buffer)
+		if out := buffer.String(); out != tt.surrogate {
+			t.Errorf("ConvertRunes(%U) with WithEscapeSurrogates = %s, want %s", tt.r, out, tt.surrogate)
+		}
+	}
+	// like decoding UTF-8
+	if s := string([]rune{0xd800}); s != "\ufffd" {
+		t.Errorf("Expected U+FFFD, got %q", s)
+	}
+}
+
+// TestConvertRunesInvalidModes tests that runes that are not code points
+// are escaped the same way in every mode.
+func TestConvertRunesInvalidModes(t *testing.T) {
+	tests := []struct {
+		opts     []Option
+		expected string
+	}{
+		{nil, `\ufffd`},
+		{[]Option{WithASCII()}, `\ufffd`},
+		{[]Option{WithGraphic()}, `\ufffd`},
+		{[]Option{WithLiteralWhitespace()}, `\ufffd`},
+		{[]Option{WithHTML()}, `\ufffd`},
+		{[]Option{WithInvalidUTF8(ReplacementChar)}, `\ufffd`},
+		{[]Option{WithInvalidUTF8(Drop)}, `\ufffd`},
+		{[]Option{WithStrictUTF8()}, `\ufffd`},
+		{[]Option{WithUppercaseHex()}, `\uFFFD`},
+		{[]Option{WithUEscapePrefix(UpperPrefix)}, `\Ufffd`},
+		{[]Option{WithHexAlphabet("ghijklmnopqrstuv")}, `\uvvvt`},
+		{[]Option{WithByteSlice()}, `0xef, 0xbf, 0xbd,`},
+	}
+	for _, r := range []rune{-1, utf8.MaxRune + 1, 0x7fffffff, -0x80000000, 0xd800, 0xdfff} {
+		for _, tt := range tests {
+			var buffer bytes.Buffer
+			_, err := New(tt.opts...).ConvertRunes([]rune{r}, &buffer)
+			if err != nil {
+				t.Fatalf("ConvertRunes failed: %v", err)
+			}
+			if out := buffer.String(); out != tt.expected {
+				t.Errorf("ConvertRunes(%#x) = %s, want %s", r, out, tt.expected)
+			}
+		}
+		if r < 0 || r > utf8.MaxRune {
+			if out := string(EscapeRune(nil, r, true)); out != `\ufffd` {
+				t.Errorf("EscapeRune(%#x) = %s, want %s", r, out, `\ufffd`)
+			}
+		}
+	}
+}
+
+func TestQuoteGo(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"", "``"},
+		{"abc", "`abc`"},
+		{"a\"b\\c", "`a\"b\\c`"},
+		{"line 1\n\tline 2\n", "`line 1\n\tline 2\n`"},
+		{"\u263a\u00ad", "`\u263a\u00ad`"},
+		{"a`b", `"a` + "`" + `b"`},
+		{"a\r\n", `"a\r\n"`},
+		{"\x00", `"\x00"`},
+		{"\x7f", `"\x7f"`},
+		{"\xff", `"\xff"`},
+		{"\ufeffa", `"\ufeffa"`},
+	}
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		n, err := QuoteGo(tt.in, &buffer)
+		if err != nil {
+			t.Fatalf("QuoteGo failed: %v", err)
+		}
+		if out := buffer.String(); out != tt.expected {
+			t.Errorf("QuoteGo(%q) = %s, want %s", tt.in, out, tt.expected)
+		}
+		if n != buffer.Len() {
+			t.Errorf("QuoteGo(%q) returned %d, wrote %d bytes", tt.in, n, buffer.Len())
+		}
+		if unquoted, err := strconv.Unquote(buffer.String()); err != nil || unquoted != tt.in {
+			t.Errorf("Unquote(%s) = %q, %v, want %q", buffer.String(), unquoted, err, tt.in)
+		}
+	}
+}
+
+func TestQuoteLogfmt(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"", `""`},
+		{"abc", "abc"},
+		{"/api/v1?x", "/api/v1?x"},
+		{"\u263a-\u00e9", "\u263a-\u00e9"},
+		{"a b", `"a b"`},
+		{"a=b", `"a=b"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`C:\dir`, `"C:\\dir"`},
+		{"a\tb", `"a\tb"`},
+		{"line\n", `"line\n"`},
+		{"\u00a0", `"\u00a0"`},
+		{"\xff", `"\xff"`},
+	}
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		n, err := QuoteLogfmt(tt.in, &buffer)
+		if err != nil {
+			t.Fatalf("QuoteLogfmt failed: %v", err)
+		}
+		if out := buffer.String(); out != tt.expected {
+			t.Errorf("QuoteLogfmt(%q) = %s, want %s", tt.in, out, tt.expected)
+		}
+		if n != buffer.Len() {
+			t.Errorf("QuoteLogfmt(%q) returned %d, wrote %d bytes", tt.in, n, buffer.Len())
+		}
+	}
+}
+
+func TestConvertAll(t *testing.T) {
+	converter := New()
+
+	for _, tt := range quotetests {
+		for _, r := range []io.Reader{
+			strings.NewReader(tt.in),
+			iotest.OneByteReader(strings.NewReader(tt.in)),
+		} {
+			out, err := converter.ConvertAll(r)
+			if err != nil {
+				t.Fatalf("Converter failed: %v", err)
+			}
+			expected := tt.out[1 : len(tt.out)-1]
+			if !testEqual(string(out), expected) {
+				t.Errorf("Quote(%s) = %s, want %s", tt.in, out, expected)
+			}
+		}
+	}
+}
+
+func TestConvertBytes(t *testing.T) {
+	converter := New()
+
+	for _, tt := range quotetests {
+		var buffer bytes.Buffer
+		n, err := converter.ConvertBytes([]byte(tt.in), &buffer)
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		expected := tt.out[1 : len(tt.out)-1]
+		if out := buffer.String(); !testEqual(out, expected) {
+			t.Errorf("Quote(%s) = %s, want %s", tt.in, out, expected)
+		}
+		if n != buffer.Len() {
+			t.Errorf("Quote(%s) returned %d, wrote %d bytes", tt.in, n, buffer.Len())
+		}
+	}
+
+	b, err := ioutil.ReadAll(generateTestString())
+	if err != nil {
+		t.Fatalf("Failed to read large string into buffer: %v", err)
+	}
+	var expected, got bytes.Buffer
+	converter.Convert(bytes.NewReader(b), &expected)
+	converter.ConvertBytes(b, &got)
+	if !bytes.Equal(expected.Bytes(), got.Bytes()) {
+		t.Errorf("Large string does not match")
+	}
+}
+
+var errTest = errors.New("test error")
+
+// failingReader returns the data in its reader, and err once it's exhausted.
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		err = f.err
+	}
+	return n, err
+}
+
+func TestReadError(t *testing.T) {
+	converter := New()
+	in := &failingReader{
+		r:   strings.NewReader("abc\n"),
+		err: errTest,
+	}
+
+	var buffer bytes.Buffer
+	_, err := converter.Convert(in, &buffer)
+	if !errors.Is(err, errTest) {
+		t.Fatalf("Expected %v, got %v", errTest, err)
+	}
+	expected := "streamquote: read error after 4 bytes: test error"
+	if err.Error() != expected {
+		t.Errorf("Expected error %q, got %q", expected, err.Error())
+	}
+}
+
+// dataErrorReader returns its data together with err in a single Read.
+type dataErrorReader struct {
+	data string
+	err  error
+}
+
+func (d *dataErrorReader) Read(p []byte) (int, error) {
+	n := copy(p, d.data)
+	d.data = d.data[n:]
+	if len(d.data) == 0 {
+		return n, d.err
+	}
+	return n, nil
+}
+
+func TestReadErrorWithData(t *testing.T) {
+	converter := New()
+	in := &dataErrorReader{
+		data: "abc\n\xff",
+		err:  errTest,
+	}
+
+	var buffer bytes.Buffer
+	n, err := converter.Convert(in, &buffer)
+	if !errors.Is(err, errTest) {
+		t.Fatalf("Expected %v, got %v", errTest, err)
+	}
+	expected := `abc\n\xff`
+	if out := buffer.String(); out != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+	if n != len(expected) {
+		t.Errorf("Expected %d bytes, got %d", len(expected), n)
+	}
+}
+
+func TestNilReader(t *testing.T) {
+	converter := New()
+
+	var buffer bytes.Buffer
+	_, err := converter.Convert(nil, &buffer)
+	if err != ErrNilReader {
+		t.Fatalf("Expected %v, got %v", ErrNilReader, err)
+	}
+}
+
+func TestNilWriter(t *testing.T) {
+	converter := New()
+
+	_, err := converter.Convert(strings.NewReader("abc"), nil)
+	if err != ErrNilWriter {
+		t.Fatalf("Expected %v, got %v", ErrNilWriter, err)
+	}
+}
+
+// plainWriter hides all methods of the writer except Write.
+type plainWriter struct {
+	w io.Writer
+}
+
+func (p plainWriter) Write(b []byte) (int, error) {
+	return p.w.Write(b)
+}
+
+// TestWriterKinds tests that writers with and without
+// WriteString get the same output.
+func TestWriterKinds(t *testing.T) {
+	converter := New()
+
+	for _, tt := range quotetests {
+		var stringWriter, plain bytes.Buffer
+		converter.Convert(strings.NewReader(tt.in), &stringWriter)
+		converter.Convert(strings.NewReader(tt.in), plainWriter{&plain})
+		if stringWriter.String() != plain.String() {
+			t.Errorf("Quote(%s): %s != %s", tt.in, stringWriter.String(), plain.String())
+		}
+	}
+}
+
+// TestConvertAllocs tests that escape sequences don't allocate.
+// The output is collected in the converter's output buffer and written in
+// chunks, so there's no need for a separate io.StringWriter path.
+func TestConvertAllocs(t *testing.T) {
+	in := "\a\b\f\r\n\t\v\x00\x001\u263a\u00ad\U0010ffff\U0001f600\xff\xe2\x98\"'<&\\\u2028\r\n"
+	for _, opts := range [][]Option{
+		nil,
+		{WithQuotes(), WithASCII()},
+		{WithPython()},
+		{WithJavaScript(), WithUppercaseHex()},
+		{WithCSV()},
+		{WithHTML(), WithGraphic()},
+		{WithNulShortForm(), WithNormalizeNewlines(), WithExpandTabs(4)},
+		{WithInvalidUTF8(ReplacementChar), WithMinimalEscaping()},
+		{WithLineWrap(8, ""), WithColumnTracking()},
+		{WithByteSlice()},
+		{WithPercentEncoding("")},
+	} {
+		converter := New(opts...)
+		r := strings.NewReader(in)
+		converter.Convert(r, ioutil.Discard)
+		runes := []rune(in)
+
+		allocs := testing.AllocsPerRun(100, func() {
+			r.Seek(0, io.SeekStart)
+			converter.Convert(r, ioutil.Discard)
+		})
+		if allocs != 0 {
+			t.Errorf("Expected no allocations with %d options, got %v", len(opts), allocs)
+		}
+		allocs = testing.AllocsPerRun(100, func() {
+			converter.ConvertRunes(runes, ioutil.Discard)
+		})
+		if allocs != 0 {
+			t.Errorf("Expected no allocations in ConvertRunes with %d options, got %v", len(opts), allocs)
+		}
+	}
+}
+
+// emptyReader always returns no data and no error.
+type emptyReader struct{}
+
+func (emptyReader) Read(p []byte) (int, error) {
+	return 0, nil
+}
+
+func TestNoProgress(t *testing.T) {
+	converter := New()
+
+	var buffer bytes.Buffer
+	_, err := converter.Convert(io.MultiReader(strings.NewReader("abc"), emptyReader{}), &buffer)
+	if !errors.Is(err, io.ErrNoProgress) {
+		t.Fatalf("Expected %v, got %v", io.ErrNoProgress, err)
+	}
+	if out := buffer.String(); out != "abc" {
+		t.Errorf("Expected abc, got %s", out)
+	}
+}
+
+// countingWriter counts the calls to Write.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Buffer.Write(p)
+}
+
+// failingWriter accepts limit bytes, then returns err.
+type failingWriter struct {
+	limit int
+	err   error
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > f.limit {
+		n := f.limit
+		f.limit = 0
+		return n, f.err
+	}
+	f.limit -= len(p)
+	return len(p), nil
+}
+
+func TestConvertTee(t *testing.T) {
+	converter := New()
+	in := strings.Repeat("abc\n\u263a", 10000)
+	expected := strconv.Quote(in)
+	expected = expected[1 : len(expected)-1]
+
+	var a, b countingWriter
+	n, err := converter.ConvertTee(strings.NewReader(in), &a, &b)
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if n != len(expected) {
+		t.Errorf("Expected %d bytes, got %d", len(expected), n)
+	}
+	for _, w := range []*countingWriter{&a, &b} {
+		if w.String() != expected {
+			t.Errorf("Output does not match")
+		}
+		if max := len(expected)/outBufSize + 1; w.writes > max {
+			t.Errorf("Expected at most %d writes, got %d", max, w.writes)
+		}
+	}
+}
+
+func TestConvertTeeError(t *testing.T) {
+	converter := New()
+	in := strings.Repeat("abc", outBufSize)
+
+	var a, b bytes.Buffer
+	failing := &failingWriter{limit: 10, err: errTest}
+	n, err := converter.ConvertTee(strings.NewReader(in), &a, failing, &b)
+	if err != errTest {
+		t.Fatalf("Expected %v, got %v", errTest, err)
+	}
+	if n != 10 {
+		t.Errorf("Expected 10 bytes, got %d", n)
+	}
+	if a.Len() != outBufSize {
+		t.Errorf("Expected first writer to receive %d bytes, got %d", outBufSize, a.Len())
+	}
+	if b.Len() != 0 {
+		t.Errorf("Expected last writer to receive no data, got %d bytes", b.Len())
+	}
+
+	a.Reset()
+	n, err = converter.ConvertTee(strings.NewReader(in), &a, nil)
+	if err != ErrNilWriter {
+		t.Errorf("Expected %v, got %v", ErrNilWriter, err)
+	}
+	if n != 0 || a.Len() != 0 {
+		t.Errorf("Expected no output, got %d bytes", a.Len())
+	}
+
+	if _, err := converter.ConvertTee(strings.NewReader(in)); err != ErrNilWriter {
+		t.Errorf("Expected %v, got %v", ErrNilWriter, err)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	converter := New()
+
+	n, err := converter.Convert(strings.NewReader("abc\n"), &failingWriter{limit: 2, err: errTest})
+	if err != errTest {
+		t.Fatalf("Expected %v, got %v", errTest, err)
+	}
+	if n != 2 {
+		t.Errorf("Expected 2 bytes, got %d", n)
+	}
+}
+
+// overcountingWriter claims to write one byte more than it was given.
+type overcountingWriter struct{}
+
+func (overcountingWriter) Write(p []byte) (int, error) {
+	return len(p) + 1, nil
+}
+
+func TestBadWriter(t *testing.T) {
+	converter := New()
+
+	n, err := converter.Convert(strings.NewReader("abc\n"), overcountingWriter{})
+	if err != ErrBadWriter {
+		t.Fatalf("Expected %v, got %v", ErrBadWriter, err)
+	}
+	if n != 0 {
+		t.Errorf("Expected 0 bytes, got %d", n)
+	}
+}
+
 // Size of the large string for benchmarking.
 const largeSize = 10 * 1024 * 1024
 
@@ -104,35 +958,234 @@ func TestLargeString(t *testing.T) {
 	}
 }
 
-func BenchmarkConverterSmall(b *testing.B) {
+func BenchmarkConverterSmall(b *testing.B) {
+	converter := New()
+	r := strings.NewReader("\a\b\f\r\n\t\v\a\b\f\r\n\t\v\a\b\f\r\n\t\v")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		converter.Convert(r, ioutil.Discard)
+		r.Seek(0, 0)
+	}
+}
+
+func BenchmarkStrconvQuoteSmall(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		strconv.Quote("\a\b\f\r\n\t\v\a\b\f\r\n\t\v\a\b\f\r\n\t\v")
+	}
+}
+
+// BenchmarkConverterLarge converts random bytes, so about half of the
+// input is invalid UTF-8, and the runs of printable ASCII are short.
+//
+// The checks of the options added to the per-rune loop made it slower
+// than the first version, which wrote each rune to the writer directly.
+// Deciding once per conversion whether write and writeWrapped have
+// anything to do, and escaping the bytes that are always invalid UTF-8
+// in the same runs as the escaped ASCII bytes, brought it back:
+//
+//	                          first version   before        after
+//	BenchmarkConverterLarge   262-351 ms      357-530 ms    297-430 ms
+func BenchmarkConverterLarge(b *testing.B) {
+	converter := New()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		// Using ioutil.Discard here may not seem fair,
+		// because strconv.Quote has to allocate the result string,
+		// but the point of this package is that you don't have to
+		// allocate the entire result string, you can stream the result.
+		converter.Convert(generateLargeString(), ioutil.Discard)
+	}
+}
+
+func BenchmarkConverterBufferLarge(b *testing.B) {
+	converter := New()
+	bs, err := ioutil.ReadAll(generateLargeString())
+	if err != nil {
+		b.Fatalf("Failed to read large string into buffer: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var buffer bytes.Buffer
+		converter.Convert(bytes.NewReader(bs), &buffer)
+	}
+}
+
+func BenchmarkConverterConvertAllLarge(b *testing.B) {
+	converter := New()
+	bs, err := ioutil.ReadAll(generateLargeString())
+	if err != nil {
+		b.Fatalf("Failed to read large string into buffer: %v", err)
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		converter.ConvertAll(bytes.NewReader(bs))
+	}
+}
+
+// BenchmarkConverterAllControl benchmarks the worst case,
+// where every byte is a control character written as \xHH.
+func BenchmarkConverterAllControl(b *testing.B) {
+	converter := New()
+	bs := bytes.Repeat([]byte{0x01}, largeSize)
+
+	b.SetBytes(int64(len(bs)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		converter.Convert(bytes.NewReader(bs), ioutil.Discard)
+	}
+}
+
+// TestAllControl tests the fast path for runs of escaped ASCII bytes.
+func TestAllControl(t *testing.T) {
+	in := strings.Repeat("\x01", 3*DefaultBufferSize+1)
+	expected := strconv.Quote(in)
+	var out bytes.Buffer
+	stats, err := New(WithQuotes()).ConvertStats(strings.NewReader(in), &out)
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if out.String() != expected {
+		t.Errorf("Output does not match")
+	}
+	if expected := (Stats{RunesTotal: len(in), RunesEscaped: len(in), BytesWritten: len(expected)}); stats != expected {
+		t.Errorf("Expected %+v, got %+v", expected, stats)
+	}
+
+	// the same output and stats as without the escape table
+	mixed := strings.Repeat("\x00\x01\a\n\r\"\\\x7f&a\u263a\xff0\x80\xc0\xc1\u263a\xf5\xe2\x98", 1000)
+	for _, opts := range [][]Option{nil, {WithASCII()}, {WithHTML()}, {WithLiteralWhitespace()},
+		{WithNulShortForm()}, {WithNormalizeNewlines()}, {WithCSV()}, {WithMaxOutput(5000)},
+		{WithShortEscapes(map[rune][]byte{'\n': nil})}, {WithReplacement('\x01', nil)},
+		{WithUppercaseHex()}, {WithPython()}, {WithJavaScript()}, {WithInvalidUTF8(ReplacementChar)},
+		{WithInvalidUTF8(Drop)}, {WithVerifyGoLiteral()}, {WithBufferSize(16)}} {
+		fast := newConverter(opts...)
+		slow := newConverter(opts...)
+		slow.escapes = nil
+		var want, got bytes.Buffer
+		expected, expectedErr := slow.ConvertStats(strings.NewReader(mixed), &want)
+		stats, err := fast.ConvertStats(strings.NewReader(mixed), &got)
+		if err != expectedErr {
+			t.Errorf("Expected %v, got %v", expectedErr, err)
+		}
+		if got.String() != want.String() {
+			t.Errorf("Output does not match with %d options", len(opts))
+		}
+		if stats != expected {
+			t.Errorf("Expected %+v, got %+v", expected, stats)
+		}
+	}
+
+	// the output limit is never crossed in the middle of an escape sequence
+	var buffer bytes.Buffer
+	_, err = New(WithMaxOutput(4099)).Convert(strings.NewReader(in), &buffer)
+	if err != ErrOutputTooLarge {
+		t.Fatalf("Expected %v, got %v", ErrOutputTooLarge, err)
+	}
+	if buffer.Len() != 4096 {
+		t.Errorf("Expected 4096 bytes, got %d", buffer.Len())
+	}
+
+	buffer.Reset()
+	_, truncated, err := New().ConvertDisplay(strings.NewReader(in), &buffer, 5)
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if expected := strings.Repeat(`\x01`, 5) + "..."; buffer.String() != expected || !truncated {
+		t.Errorf("Expected %s, got %s", expected, buffer.String())
+	}
+}
+
+// testSize is the size of the input of the tests that check the behavior
+// with large input. It spans several read and output buffers, but it's
+// much smaller than largeSize, which is for TestLargeString and the
+// benchmarks, so that the tests stay fast.
+const testSize = 4 * DefaultBufferSize
+
+// generateTestString returns the first testSize bytes of the large string.
+func generateTestString() io.Reader {
+	return io.LimitReader(generateLargeString(), testSize)
+}
+
+// generateTestText returns the large text, cut to about testSize bytes.
+func generateTestText() string {
+	return generateText(testSize)
+}
+
+// generateLargeText returns mostly printable ASCII text
+// with some escapes and multi-byte runes.
+func generateLargeText() string {
+	return generateText(largeSize)
+}
+
+// generateText returns the lines of the large text,
+// until they're at least size bytes long.
+func generateText(size int) string {
+	var b strings.Builder
+	line := "The quick brown fox jumps over the lazy dog. \"Quoted\", tab\t, ☺.\n"
+	for b.Len() < size {
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+func BenchmarkConverterTextLarge(b *testing.B) {
 	converter := New()
-	r := strings.NewReader("\a\b\f\r\n\t\v\a\b\f\r\n\t\v\a\b\f\r\n\t\v")
+	s := generateLargeText()
 
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		converter.Convert(r, ioutil.Discard)
-		r.Seek(0, 0)
+		converter.Convert(strings.NewReader(s), ioutil.Discard)
 	}
 }
 
-func BenchmarkStrconvQuoteSmall(b *testing.B) {
+func BenchmarkStrconvQuoteTextLarge(b *testing.B) {
+	s := generateLargeText()
+
+	b.ResetTimer()
+
 	for i := 0; i < b.N; i++ {
-		strconv.Quote("\a\b\f\r\n\t\v\a\b\f\r\n\t\v\a\b\f\r\n\t\v")
+		strconv.Quote(s)
 	}
 }
 
-func BenchmarkConverterLarge(b *testing.B) {
+func BenchmarkConverterReader1MB(b *testing.B) {
 	converter := New()
+	bs, err := ioutil.ReadAll(io.LimitReader(generateLargeString(), 1024*1024))
+	if err != nil {
+		b.Fatalf("Failed to read large string into buffer: %v", err)
+	}
 
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		// Using ioutil.Discard here may not seem fair,
-		// because strconv.Quote has to allocate the result string,
-		// but the point of this package is that you don't have to
-		// allocate the entire result string, you can stream the result.
-		converter.Convert(generateLargeString(), ioutil.Discard)
+		converter.Convert(bytes.NewReader(bs), ioutil.Discard)
+	}
+}
+
+func BenchmarkConverterBytes1MB(b *testing.B) {
+	converter := New()
+	bs, err := ioutil.ReadAll(io.LimitReader(generateLargeString(), 1024*1024))
+	if err != nil {
+		b.Fatalf("Failed to read large string into buffer: %v", err)
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		converter.ConvertBytes(bs, ioutil.Discard)
 	}
 }
 
@@ -203,3 +1256,874 @@ func TestTestEqualOldGo(t *testing.T) {
 	test("\\x7f\\u007f", "\\u007f\\x7f", true)
 	test("\\x7", "\\u007f", false)
 }
+
+func TestConvertLimit(t *testing.T) {
+	tests := []struct {
+		in       string
+		limit    int
+		expected string
+		rest     string
+		// output if the reader is not an io.ByteScanner, if different
+		plain string
+	}{
+		{"abc", 0, ``, "abc", ""},
+		{"abc", 2, `ab`, "c", ""},
+		{"abc", 5, `abc`, "", ""},
+		{"a☺b", 2, `a☺`, "b", ""},
+		{"a☺b", 3, `a☺`, "b", ""},
+		{"a☺b", 4, `a☺`, "b", ""},
+		{"a\U000fabcdb", 2, `a\U000fabcd`, "b", ""},
+		{"a\xe2\x98", 2, `a\xe2\x98`, "", ""},
+		{"a\xe2\x98b", 2, `a\xe2\x98`, "b", `a\xe2\x98b`},
+		{"a\xe2b", 2, `a\xe2`, "b", `a\xe2b`},
+		{"a\xffb", 2, `a\xff`, "b", ""},
+		{"\xe2\x98\xe2\x98\xba", 2, `\xe2\x98`, "\xe2\x98\xba", `\xe2\x98\xe2`},
+	}
+	converter := New()
+	for _, tt := range tests {
+		for _, scanner := range []bool{true, false} {
+			r := bytes.NewReader([]byte(tt.in))
+			var in io.Reader = r
+			expected, expectedRest := tt.expected, tt.rest
+			if !scanner {
+				in = struct{ io.Reader }{r}
+				if tt.plain != "" {
+					expected, expectedRest = tt.plain, tt.rest[1:]
+				}
+			}
+			var buffer bytes.Buffer
+			n, err := converter.ConvertLimit(in, &buffer, tt.limit)
+			if err != nil {
+				t.Fatalf("ConvertLimit failed: %v", err)
+			}
+			if out := buffer.String(); out != expected {
+				t.Errorf("ConvertLimit(%q, %d) = %s, want %s", tt.in, tt.limit, out, expected)
+			}
+			if n != buffer.Len() {
+				t.Errorf("ConvertLimit(%q, %d) returned %d, wrote %d bytes", tt.in, tt.limit, n, buffer.Len())
+			}
+			rest, _ := ioutil.ReadAll(r)
+			if string(rest) != expectedRest {
+				t.Errorf("ConvertLimit(%q, %d) left %q, want %q", tt.in, tt.limit, rest, expectedRest)
+			}
+		}
+	}
+}
+
+// chunkReader returns the data of r in chunks of at most size bytes,
+// like a network connection.
+type chunkReader struct {
+	r    io.Reader
+	size int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(p) > c.size {
+		p = p[:c.size]
+	}
+	return c.r.Read(p)
+}
+
+// BenchmarkConverterRefill measures the cost of refilling the read buffer:
+// the reader returns chunks that end in the middle of a rune, so every
+// refill has to move the bytes of an incomplete rune to the front.
+//
+// Reading into the free tail of the buffer instead, and only moving the
+// leftover bytes once less than half of the buffer was free, made no
+// difference beyond noise, here or in BenchmarkConverterLarge:
+//
+//	                           moving        reading into the tail
+//	BenchmarkConverterRefill   3.0-4.0 ms    2.5-4.7 ms
+//	BenchmarkConverterLarge    281-454 ms    294-397 ms
+//
+// The leftover is never more than utf8.UTFMax-1 bytes, and the time
+// is spent converting the runes, so the buffer is still moved.
+func BenchmarkConverterRefill(b *testing.B) {
+	converter := New()
+	in := []byte(strings.Repeat("☺", 64*1024))
+
+	b.SetBytes(int64(len(in)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		converter.Convert(&chunkReader{bytes.NewReader(in), 1021}, ioutil.Discard)
+	}
+}
+
+func TestNewWithBuffer(t *testing.T) {
+	in, err := ioutil.ReadAll(generateTestString())
+	if err != nil {
+		t.Fatalf("Failed to read large string: %v", err)
+	}
+	expected := strconv.Quote(string(in))
+
+	buf := make([]byte, 16)
+	c := NewWithBuffer(buf, WithQuotes())
+	out, err := c.ConvertAll(bytes.NewReader(in))
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if !testEqual(string(out), expected) {
+		t.Errorf("Output does not match")
+	}
+	if l := len(c.readBuffer); l != len(buf) {
+		t.Errorf("Expected buffer of %d bytes, got %d", len(buf), l)
+	}
+	if &c.readBuffer[0] != &buf[0] {
+		t.Errorf("Converter doesn't use the given buffer")
+	}
+	if clone := c.Clone(); len(clone.readBuffer) != len(buf) || &clone.readBuffer[0] == &buf[0] {
+		t.Errorf("Clone should have its own buffer of %d bytes", len(buf))
+	}
+
+	for _, size := range []int{0, utf8.UTFMax - 1} {
+		_, err := NewWithBuffer(make([]byte, size)).ConvertAll(bytes.NewReader(in))
+		if !errors.Is(err, ErrBufferTooSmall) {
+			t.Errorf("Buffer size %d: expected %v, got %v", size, ErrBufferTooSmall, err)
+		}
+	}
+	if _, err := NewWithBuffer(nil).ConvertAll(bytes.NewReader(in)); !errors.Is(err, ErrBufferTooSmall) {
+		t.Errorf("nil buffer: expected %v, got %v", ErrBufferTooSmall, err)
+	}
+}
+
+func TestConvertDisplay(t *testing.T) {
+	tests := []struct {
+		in        string
+		maxRunes  int
+		expected  string
+		truncated bool
+	}{
+		{"abc", 5, `"abc"`, false},
+		{"abc", 3, `"abc"`, false},
+		{"abcd", 3, `"abc"...`, true},
+		{"abc", 0, `""...`, true},
+		{"", 0, `""`, false},
+		{"☺☺☺☺", 2, `"☺☺"...`, true},
+		{"a\nb\xff\xfec", 4, `"a\nb\xff"...`, true},
+		{"a\nb\xff", 4, `"a\nb\xff"`, false},
+		{strings.Repeat("x", DefaultBufferSize) + "y", DefaultBufferSize, `"` + strings.Repeat("x", DefaultBufferSize) + `"...`, true},
+		{strings.Repeat("x", DefaultBufferSize), DefaultBufferSize, `"` + strings.Repeat("x", DefaultBufferSize) + `"`, false},
+	}
+	converter := New(WithQuotes())
+	for _, tt := range tests {
+		for _, r := range []io.Reader{
+			strings.NewReader(tt.in),
+			iotest.OneByteReader(strings.NewReader(tt.in)),
+		} {
+			var buffer bytes.Buffer
+			n, truncated, err := converter.ConvertDisplay(r, &buffer, tt.maxRunes)
+			if err != nil {
+				t.Fatalf("ConvertDisplay failed: %v", err)
+			}
+			if out := buffer.String(); out != tt.expected || truncated != tt.truncated {
+				t.Errorf("ConvertDisplay(%.20q, %d) = %.30s, %v, want %.30s, %v", tt.in, tt.maxRunes, out, truncated, tt.expected, tt.truncated)
+			}
+			if n != buffer.Len() {
+				t.Errorf("ConvertDisplay(%.20q, %d) returned %d, wrote %d bytes", tt.in, tt.maxRunes, n, buffer.Len())
+			}
+		}
+	}
+
+	// the limit only applies to ConvertDisplay
+	out, err := converter.ConvertAll(strings.NewReader("abcd"))
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if string(out) != `"abcd"` {
+		t.Errorf("Expected %s, got %s", `"abcd"`, out)
+	}
+
+	var buffer bytes.Buffer
+	_, _, err = New(WithEllipsis("\u2026")).ConvertDisplay(strings.NewReader("abcd"), &buffer, 2)
+	if err != nil {
+		t.Fatalf("ConvertDisplay failed: %v", err)
+	}
+	if out := buffer.String(); out != "ab\u2026" {
+		t.Errorf("Expected %s, got %s", "ab\u2026", out)
+	}
+
+	// the ellipsis isn't part of the verified literal
+	verified := New(WithQuotes(), WithVerifyGoLiteral())
+	for _, tt := range tests {
+		buffer.Reset()
+		if _, _, err := verified.ConvertDisplay(strings.NewReader(tt.in), &buffer, tt.maxRunes); err != nil {
+			t.Errorf("ConvertDisplay(%.20q, %d) with verification failed: %v", tt.in, tt.maxRunes, err)
+		}
+		if out := buffer.String(); out != tt.expected {
+			t.Errorf("ConvertDisplay(%.20q, %d) = %.30s, want %.30s", tt.in, tt.maxRunes, out, tt.expected)
+		}
+	}
+}
+
+// TestInterfaces documents the interfaces that the exported
+// types and the values returned by the package implement.
+func TestInterfaces(t *testing.T) {
+	values := []struct {
+		name  string
+		value interface{}
+	}{
+		{"*Writer", NewWriter(ioutil.Discard)},
+		{"QuoteReader", QuoteReader("")},
+		{"New", New()},
+	}
+	interfaces := []struct {
+		name  string
+		check func(interface{}) bool
+	}{
+		{"io.Reader", func(v interface{}) bool { _, ok := v.(io.Reader); return ok }},
+		{"io.Writer", func(v interface{}) bool { _, ok := v.(io.Writer); return ok }},
+		{"io.Closer", func(v interface{}) bool { _, ok := v.(io.Closer); return ok }},
+		{"io.StringWriter", func(v interface{}) bool { _, ok := v.(io.StringWriter); return ok }},
+		{"io.ReaderFrom", func(v interface{}) bool { _, ok := v.(io.ReaderFrom); return ok }},
+		{"io.WriterTo", func(v interface{}) bool { _, ok := v.(io.WriterTo); return ok }},
+		{"Converter", func(v interface{}) bool { _, ok := v.(Converter); return ok }},
+	}
+	implements := map[string][]string{
+		"*Writer":     {"io.Writer", "io.Closer", "io.StringWriter"},
+		"QuoteReader": {"io.Reader"},
+		"New":         {"Converter"},
+	}
+	for _, v := range values {
+		for _, i := range interfaces {
+			expected := false
+			for _, name := range implements[v.name] {
+				if name == i.name {
+					expected = true
+				}
+			}
+			if got := i.check(v.value); got != expected {
+				t.Errorf("%s implements %s: %v, want %v", v.name, i.name, got, expected)
+			}
+		}
+	}
+}
+
+func TestTotalWritten(t *testing.T) {
+	converter := New(WithQuotes())
+	sum := 0
+	for _, in := range []string{"abc", "\xff\n", "\u263a"} {
+		n, err := converter.Convert(strings.NewReader(in), ioutil.Discard)
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		sum += n
+	}
+	if total := converter.TotalWritten(); total != int64(sum) {
+		t.Errorf("Expected %d bytes in total, got %d", sum, total)
+	}
+	if clone := converter.Clone(); clone.TotalWritten() != 0 {
+		t.Errorf("Expected clone to start at 0, got %d", clone.TotalWritten())
+	}
+
+	converter.Reset()
+	if total := converter.TotalWritten(); total != 0 {
+		t.Errorf("Expected 0 bytes after Reset, got %d", total)
+	}
+	n, err := converter.ConvertBytes([]byte("abc"), ioutil.Discard)
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if total := converter.TotalWritten(); total != int64(n) {
+		t.Errorf("Expected %d bytes in total, got %d", n, total)
+	}
+}
+
+func TestConvertPartial(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+		tail     string
+	}{
+		{"abc", "abc", ""},
+		{"abc\xe2\x98", "abc", "\xe2\x98"},
+		{"\xf0\x9f\x98", "", "\xf0\x9f\x98"},
+		{"\xe2", "", "\xe2"},
+		{"a\xff", `a\xff`, ""},
+		{"a\xe2\x98\xff", `a\xe2\x98\xff`, ""},
+		{"\u263a\x00", "\u263a" + `\x00`, ""},
+	}
+	converter := New(WithQuotes())
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		n, tail, err := converter.ConvertPartial(iotest.OneByteReader(strings.NewReader(tt.in)), &buffer)
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if expected := `"` + tt.expected + `"`; buffer.String() != expected {
+			t.Errorf("ConvertPartial(%q) = %s, want %s", tt.in, buffer.String(), expected)
+		}
+		if n != buffer.Len() {
+			t.Errorf("Expected %d bytes, got %d", buffer.Len(), n)
+		}
+		if string(tail) != tt.tail {
+			t.Errorf("ConvertPartial(%q) tail = %q, want %q", tt.in, tail, tt.tail)
+		}
+	}
+
+	// prepending the tail to the next frame completes the rune
+	var buffer bytes.Buffer
+	_, tail, _ := converter.ConvertPartial(strings.NewReader("a\xe2"), &buffer)
+	converter.ConvertPartial(io.MultiReader(bytes.NewReader(tail), strings.NewReader("\x98\xbab")), &buffer)
+	if expected := "\"a\"\"\u263ab\""; buffer.String() != expected {
+		t.Errorf("Expected %s, got %s", expected, buffer.String())
+	}
+
+	// the tail is returned along with a read error
+	testErr := errors.New("test error")
+	_, tail, err := converter.ConvertPartial(&dataErrorReader{data: "a\xe2\x98", err: testErr}, ioutil.Discard)
+	if !errors.Is(err, testErr) {
+		t.Errorf("Expected %v, got %v", testErr, err)
+	}
+	if string(tail) != "\xe2\x98" {
+		t.Errorf("Expected tail %q, got %q", "\xe2\x98", tail)
+	}
+}
+
+func TestConvertResume(t *testing.T) {
+	in := "héllo ☺\t\"wörld\"\n"
+	opts := []Option{WithQuotes(), WithPrefix([]byte("s := ")), WithSuffix([]byte(";"))}
+	converter := New(opts...)
+	full, err := converter.ConvertAll(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	start := New(WithQuotes(), WithPrefix([]byte("s := ")))
+	for offset := 0; offset <= len(in); offset++ {
+		if !utf8.RuneStart(in[offset%len(in)]) {
+			continue
+		}
+		head, err := start.ConvertAll(strings.NewReader(in[:offset]))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		// drop the closing quote
+		head = head[:len(head)-1]
+		var buffer bytes.Buffer
+		n, err := converter.ConvertResume(strings.NewReader(in[offset:]), &buffer, true)
+		if err != nil {
+			t.Fatalf("ConvertResume at %d failed: %v", offset, err)
+		}
+		if out := string(head) + buffer.String(); out != string(full) {
+			t.Errorf("Resuming at %d: expected %s, got %s", offset, full, out)
+		}
+		if n != buffer.Len() {
+			t.Errorf("Resuming at %d: returned %d, wrote %d bytes", offset, n, buffer.Len())
+		}
+	}
+
+	// the offset is in the middle of the smiley
+	mid := strings.Index(in, "☺") + 1
+	var buffer bytes.Buffer
+	n, err := converter.ConvertResume(strings.NewReader(in[mid:]), &buffer, true)
+	if !errors.Is(err, ErrMidRune) {
+		t.Errorf("Expected %v, got %v", ErrMidRune, err)
+	}
+	if n != 0 || buffer.Len() != 0 {
+		t.Errorf("Expected no output, got %d bytes: %q", n, buffer.String())
+	}
+	if _, err := converter.ConvertResume(strings.NewReader(in[mid:]), &buffer, false); err != nil {
+		t.Fatalf("ConvertResume failed: %v", err)
+	}
+	if expected := `\t\"wörld\"\n";`; buffer.String() != expected {
+		t.Errorf("Expected %s, got %s", expected, buffer.String())
+	}
+
+	// at most three continuation bytes are skipped
+	buffer.Reset()
+	if _, err := converter.ConvertResume(strings.NewReader("\x80\x80\x80\x80a"), &buffer, false); err != nil {
+		t.Fatalf("ConvertResume failed: %v", err)
+	}
+	if expected := `\x80a";`; buffer.String() != expected {
+		t.Errorf("Expected %s, got %s", expected, buffer.String())
+	}
+
+	// the bytewise modes resume at any byte
+	for _, tt := range []struct {
+		opts     []Option
+		expected string
+	}{
+		{[]Option{WithByteSlice()}, "0x80, 0x81, 0x41,"},
+		{[]Option{WithPercentEncoding("")}, "%80%81A"},
+		{[]Option{WithFullHexEscape()}, `\x80\x81\x41`},
+	} {
+		for _, atRuneBoundary := range []bool{true, false} {
+			buffer.Reset()
+			if _, err := New(tt.opts...).ConvertResume(strings.NewReader("\x80\x81A"), &buffer, atRuneBoundary); err != nil {
+				t.Fatalf("ConvertResume failed: %v", err)
+			}
+			if buffer.String() != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, buffer.String())
+			}
+		}
+	}
+
+	// the prefix and the opening quote aren't written when resuming,
+	// so they aren't expected by the verification either
+	verified := New(append(opts, WithVerifyGoLiteral())...)
+	for _, rest := range []string{"", "wörld\"\n", in} {
+		buffer.Reset()
+		if _, err := verified.ConvertResume(strings.NewReader(rest), &buffer, true); err != nil {
+			t.Errorf("ConvertResume(%q) with verification failed: %v", rest, err)
+		}
+	}
+}
+
+// TestC1Controls tests that the C1 controls, U+0080 to U+009F,
+// are escaped with the leading zeros, like strconv.Quote.
+func TestC1Controls(t *testing.T) {
+	converter := New()
+	for r := rune(0x80); r < 0xa0; r++ {
+		in := string(r)
+		expected := `\u00` + strconv.FormatInt(int64(r), 16)
+		if quoted := strconv.Quote(in); quoted != `"`+expected+`"` {
+			t.Fatalf("strconv.Quote(%q) = %s, want %q", in, quoted, expected)
+		}
+
+		var buffer bytes.Buffer
+		n, err := converter.Convert(strings.NewReader("a"+in+"b"), &buffer)
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if out := buffer.String(); out != "a"+expected+"b" {
+			t.Errorf("Convert(%q) = %s, want %s", in, out, "a"+expected+"b")
+		}
+		if n != len(expected)+2 {
+			t.Errorf("Convert(%q) returned %d, want %d", in, n, len(expected)+2)
+		}
+		if out := string(EscapeRune(nil, r, false)); out != expected {
+			t.Errorf("EscapeRune(%U) = %s, want %s", r, out, expected)
+		}
+		if converter.IsPrintable(r) {
+			t.Errorf("Expected %U not to be printable", r)
+		}
+	}
+}
+
+func TestMaxExpansionFactor(t *testing.T) {
+	tests := []struct {
+		opts     []Option
+		expected int
+	}{
+		{nil, 4},
+		// ASCII mode escapes more runes, but controls and invalid
+		// bytes expand the most in both
+		{[]Option{WithASCII()}, 4},
+		{[]Option{WithGraphic()}, 4},
+		{[]Option{WithHTML()}, 5},
+		{[]Option{WithPython()}, 6},
+		{[]Option{WithJavaScript()}, 6},
+		{[]Option{WithASCII(), WithInvalidUTF8(ReplacementChar)}, 6},
+		{[]Option{WithCSV()}, 2},
+		{[]Option{WithByteSlice()}, 6},
+		{[]Option{WithLineWrap(10, "\" +\n\"")}, 9},
+		{[]Option{WithReplacement('$', []byte("$$$$$$$$"))}, 8},
+		{[]Option{WithEscaper(DefaultEscaper)}, 0},
+		{[]Option{WithClassifier(func(r rune) bool { return r != 'a' })}, 6},
+		{[]Option{WithExpandTabs(8)}, 8},
+		{[]Option{WithTemplateSafe()}, 7},
+		{[]Option{WithShortEscapes(map[rune][]byte{'\n': []byte(`\u000a`)})}, 6},
+	}
+	r := rand.New(rand.NewSource(randSeed))
+	pieces := []string{"a", "\x00", "\xff", "\u0080", "\u00e9", "\u2028", "\ufffd",
+		"\U000fabcd", "\U0001f600", "&", "\"", "$", "\xe2\x98", "\t", "{", "\n"}
+	var inputs []string
+	for _, piece := range pieces {
+		inputs = append(inputs, strings.Repeat(piece, 100))
+	}
+	for i := 0; i < 100; i++ {
+		var b strings.Builder
+		for j := r.Intn(100); j > 0; j-- {
+			b.WriteString(pieces[r.Intn(len(pieces))])
+		}
+		inputs = append(inputs, b.String())
+	}
+	for _, tt := range tests {
+		converter := New(append(tt.opts, WithQuotes())...)
+		factor := converter.MaxExpansionFactor()
+		if factor != tt.expected {
+			t.Errorf("Expected factor %d, got %d", tt.expected, factor)
+		}
+		if factor == 0 {
+			continue
+		}
+		for _, in := range inputs {
+			n, err := converter.Convert(strings.NewReader(in), ioutil.Discard)
+			if err != nil {
+				t.Fatalf("Converter failed: %v", err)
+			}
+			if max := factor*len(in) + len("[]byte{}"); n > max {
+				t.Errorf("Convert(%.20q) wrote %d bytes, estimated at most %d", in, n, max)
+			}
+		}
+	}
+}
+
+// reentrantEscaper starts a conversion on c from Escape.
+type reentrantEscaper struct {
+	c   *Quoter
+	err error
+}
+
+func (e *reentrantEscaper) Escape(dst []byte, r rune, raw []byte) []byte {
+	_, e.err = e.c.Convert(strings.NewReader("x"), ioutil.Discard)
+	return append(dst, raw...)
+}
+
+func TestReentrant(t *testing.T) {
+	var converter *Quoter
+	var errs []error
+	converter = New(WithQuotes(), WithProgress(func(readBytes, writtenBytes int) {
+		_, err := converter.ConvertBytes([]byte("x"), ioutil.Discard)
+		errs = append(errs, err)
+		_, _, err = converter.ConvertDisplay(strings.NewReader("x"), ioutil.Discard, 1)
+		errs = append(errs, err)
+	}))
+	out, err := converter.ConvertAll(strings.NewReader("abc"))
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if expected := `"abc"`; string(out) != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+	if len(errs) == 0 {
+		t.Fatalf("Expected progress to be reported")
+	}
+	for _, err := range errs {
+		if err != ErrConverterInUse {
+			t.Errorf("Expected %v, got %v", ErrConverterInUse, err)
+		}
+	}
+
+	escaper := &reentrantEscaper{}
+	escaper.c = New(WithEscaper(escaper))
+	out, err = escaper.c.ConvertAll(strings.NewReader("abc"))
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if string(out) != "abc" {
+		t.Errorf("Expected abc, got %s", out)
+	}
+	if escaper.err != ErrConverterInUse {
+		t.Errorf("Expected %v, got %v", ErrConverterInUse, escaper.err)
+	}
+
+	// it can be used again afterwards
+	out, err = converter.ConvertAll(strings.NewReader("d"))
+	if err != nil || string(out) != `"d"` {
+		t.Errorf("Expected \"d\", got %s, %v", out, err)
+	}
+}
+
+func TestConvertLines(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"", ""},
+		{"a", "\"a\"\n"},
+		{"a\n", "\"a\"\n"},
+		{"a\n\nb\tc\r\n\xff", "\"a\"\n\"\"\n\"b\\tc\\r\"\n\"\\xff\"\n"},
+		{"\n\n", "\"\"\n\"\"\n"},
+	}
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		n, err := ConvertLines(iotest.HalfReader(strings.NewReader(tt.in)), &buffer)
+		if err != nil {
+			t.Fatalf("ConvertLines failed: %v", err)
+		}
+		if out := buffer.String(); out != tt.expected {
+			t.Errorf("ConvertLines(%q) = %q, want %q", tt.in, out, tt.expected)
+		}
+		if n != buffer.Len() {
+			t.Errorf("ConvertLines(%q) returned %d, wrote %d bytes", tt.in, n, buffer.Len())
+		}
+	}
+
+	// lines longer than the buffers
+	line := strings.Repeat("abc\u263a", 100000)
+	var buffer bytes.Buffer
+	if _, err := ConvertLines(strings.NewReader(line+"\n"+line), &buffer); err != nil {
+		t.Fatalf("ConvertLines failed: %v", err)
+	}
+	if expected := strconv.Quote(line) + "\n" + strconv.Quote(line) + "\n"; buffer.String() != expected {
+		t.Errorf("Output does not match")
+	}
+}
+
+func TestConvertToBuilder(t *testing.T) {
+	converter := New(WithQuotes())
+	for _, tt := range quotetests {
+		expected, err := converter.ConvertAll(strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		var sb strings.Builder
+		sb.WriteString("x = ")
+		n, err := converter.ConvertToBuilder(strings.NewReader(tt.in), &sb)
+		if err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if sb.String() != "x = "+string(expected) {
+			t.Errorf("ConvertToBuilder(%q) = %s, want x = %s", tt.in, sb.String(), expected)
+		}
+		if n != len(expected) {
+			t.Errorf("Expected %d bytes, got %d", len(expected), n)
+		}
+	}
+
+	// the estimate leaves room for some escape sequences
+	in := strings.Repeat("abc \u263a\U0001f600 def\n", 10000)
+	r := strings.NewReader(in)
+	var sb strings.Builder
+	allocs := testing.AllocsPerRun(10, func() {
+		r.Seek(0, io.SeekStart)
+		sb.Reset()
+		converter.ConvertToBuilder(r, &sb)
+	})
+	// growing the builder once
+	if allocs > 1 {
+		t.Errorf("Expected at most 1 allocation, got %v", allocs)
+	}
+}
+
+func TestConvertJoin(t *testing.T) {
+	converter := New(WithQuotes())
+	in := []io.Reader{strings.NewReader("a"), strings.NewReader("b\n"), strings.NewReader("☺\"")}
+	var w recordingWriter
+	n, err := converter.ConvertJoin(in, []byte(", "), &w)
+	if err != nil {
+		t.Fatalf("ConvertJoin failed: %v", err)
+	}
+	if expected := `"a", "b\n", "☺\""`; w.String() != expected {
+		t.Errorf("Expected %s, got %s", expected, w.String())
+	}
+	if n != w.Len() || converter.TotalWritten() != int64(n) {
+		t.Errorf("ConvertJoin returned %d, wrote %d bytes, total %d", n, w.Len(), converter.TotalWritten())
+	}
+	if len(w.sizes) != 1 {
+		t.Errorf("Expected a single write, got %v", w.sizes)
+	}
+
+	var buffer bytes.Buffer
+	if n, err := converter.ConvertJoin(nil, []byte(", "), &buffer); n != 0 || err != nil || buffer.Len() != 0 {
+		t.Errorf("ConvertJoin of nothing returned %d, %v, wrote %q", n, err, buffer.String())
+	}
+
+	// the items before an error are written
+	in = []io.Reader{strings.NewReader("a"), nil, strings.NewReader("b")}
+	n, err = converter.ConvertJoin(in, []byte(", "), &buffer)
+	if err != ErrNilReader {
+		t.Errorf("Expected %v, got %v", ErrNilReader, err)
+	}
+	if expected := `"a"`; buffer.String() != expected || n != len(expected) {
+		t.Errorf("Expected %s, got %s, %d bytes", expected, buffer.String(), n)
+	}
+
+	// the converter works as usual afterwards
+	buffer.Reset()
+	if _, err := converter.Convert(strings.NewReader("c"), &buffer); err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if expected := `"c"`; buffer.String() != expected {
+		t.Errorf("Expected %s, got %s", expected, buffer.String())
+	}
+
+	// the separators aren't part of the verified literals
+	buffer.Reset()
+	verified := New(WithQuotes(), WithPrefix([]byte("s = ")), WithVerifyGoLiteral())
+	in = []io.Reader{strings.NewReader("a\n"), strings.NewReader(""), strings.NewReader("\"\xff")}
+	if _, err := verified.ConvertJoin(in, []byte(", "), &buffer); err != nil {
+		t.Fatalf("ConvertJoin with verification failed: %v", err)
+	}
+	if expected := `s = "a\n", s = "", s = "\"\xff"`; buffer.String() != expected {
+		t.Errorf("Expected %s, got %s", expected, buffer.String())
+	}
+}
+
+func TestConvertCount(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithQuotes()}, {WithPython(), WithASCII()}} {
+		converter := New(opts...)
+		for _, tt := range quotetests {
+			expected, err := converter.ConvertAll(strings.NewReader(tt.in))
+			if err != nil {
+				t.Fatalf("Converter failed: %v", err)
+			}
+			total := converter.TotalWritten()
+			n, err := converter.ConvertCount(strings.NewReader(tt.in))
+			if err != nil {
+				t.Fatalf("Converter failed: %v", err)
+			}
+			if n != len(expected) {
+				t.Errorf("ConvertCount(%q) = %d, want %d", tt.in, n, len(expected))
+			}
+			if converter.TotalWritten() != total {
+				t.Errorf("ConvertCount(%q) changed TotalWritten from %d to %d", tt.in, total, converter.TotalWritten())
+			}
+		}
+	}
+}
+
+func TestConvertRuneCount(t *testing.T) {
+	tests := []struct {
+		in    string
+		runes int
+	}{
+		{"", 0},
+		{"héllo", 5},
+		{"a\xffb", 3},
+		{"\xe2\x98", 2},
+		{"☺\n\x00", 3},
+	}
+	for _, opts := range [][]Option{nil, {WithQuotes()}, {WithBufferSize(utf8.UTFMax)}} {
+		converter := New(opts...)
+		for _, tt := range tests {
+			expected, err := converter.ConvertAll(strings.NewReader(tt.in))
+			if err != nil {
+				t.Fatalf("Converter failed: %v", err)
+			}
+			var buffer bytes.Buffer
+			runes, n, err := converter.ConvertRuneCount(iotest.OneByteReader(strings.NewReader(tt.in)), &buffer)
+			if err != nil {
+				t.Fatalf("Converter failed: %v", err)
+			}
+			if runes != tt.runes {
+				t.Errorf("ConvertRuneCount(%q) counted %d runes, want %d", tt.in, runes, tt.runes)
+			}
+			if n != len(expected) || buffer.String() != string(expected) {
+				t.Errorf("ConvertRuneCount(%q) = %d, %q, want %d, %q", tt.in, n, buffer.String(), len(expected), expected)
+			}
+		}
+	}
+}
+
+// TestErrors tests that each error path returns an error
+// that can be recognized with errors.Is.
+func TestErrors(t *testing.T) {
+	errRead := errors.New("read failed")
+	var inUse *Quoter
+	var inUseErr error
+	inUse = New(WithProgress(func(int, int) {
+		_, inUseErr = inUse.ConvertRunes([]rune("a"), ioutil.Discard)
+	}))
+	tests := []struct {
+		name     string
+		convert  func() error
+		expected error
+	}{
+		{"output too large", func() error {
+			_, err := New(WithMaxOutput(2)).Convert(strings.NewReader("abc"), ioutil.Discard)
+			return err
+		}, ErrOutputTooLarge},
+		{"invalid UTF-8", func() error {
+			_, err := New(WithStrictUTF8()).Convert(strings.NewReader("abc\xff"), ioutil.Discard)
+			return err
+		}, ErrInvalidUTF8},
+		{"short write", func() error {
+			_, err := New().Convert(strings.NewReader("abc"), &failingWriter{limit: 1})
+			return err
+		}, ErrShortWrite},
+		{"bad writer", func() error {
+			_, err := New().Convert(strings.NewReader("abc"), overcountingWriter{})
+			return err
+		}, ErrBadWriter},
+		{"nil writer", func() error {
+			_, err := New().Convert(strings.NewReader("abc"), nil)
+			return err
+		}, ErrNilWriter},
+		{"nil reader", func() error {
+			_, err := New().ConvertLimit(nil, ioutil.Discard, 1)
+			return err
+		}, ErrNilReader},
+		{"read error", func() error {
+			_, err := New().Convert(iotest.TimeoutReader(strings.NewReader("abc")), ioutil.Discard)
+			return err
+		}, iotest.ErrTimeout},
+		{"read error in ConvertLines", func() error {
+			_, err := ConvertLines(io.MultiReader(strings.NewReader("a\n"), iotest.ErrReader(errRead)), ioutil.Discard)
+			return err
+		}, errRead},
+		{"in use", func() error {
+			inUse.Convert(strings.NewReader("abc"), ioutil.Discard)
+			return inUseErr
+		}, ErrConverterInUse},
+		{"conflicting options", func() error {
+			_, err := NewWithOptions(WithASCII(), WithGraphic())
+			return err
+		}, ErrConflictingOptions},
+		{"invalid option", func() error {
+			_, err := New(WithBufferSize(1)).Convert(strings.NewReader("abc"), ioutil.Discard)
+			return err
+		}, ErrBufferTooSmall},
+		{"invalid output", func() error {
+			_, err := New(WithValidateOutput(), WithCSV()).Convert(strings.NewReader("abc\xff"), ioutil.Discard)
+			return err
+		}, ErrInvalidOutput},
+		{"truncated input", func() error {
+			_, err := New(WithStrictTrailing()).Convert(strings.NewReader("abc\xf0"), ioutil.Discard)
+			return err
+		}, ErrUnexpectedEOF},
+		{"too wide", func() error {
+			_, err := New(WithFixedWidth(2)).Convert(strings.NewReader("a\x00"), ioutil.Discard)
+			return err
+		}, ErrTooWide},
+		{"mid-rune resume", func() error {
+			_, err := New().ConvertResume(strings.NewReader("\x98\xbaa"), ioutil.Discard, true)
+			return err
+		}, ErrMidRune},
+		{"invalid Go literal", func() error {
+			_, err := New(WithVerifyGoLiteral(), WithDelimiter('\'')).Convert(strings.NewReader(`"`), ioutil.Discard)
+			return err
+		}, ErrInvalidGoLiteral},
+	}
+	for _, tt := range tests {
+		err := tt.convert()
+		if !errors.Is(err, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, err)
+		}
+		if wrapped := fmt.Errorf("wrapped: %w", err); !errors.Is(wrapped, tt.expected) {
+			t.Errorf("%s: expected wrapped %v, got %v", tt.name, tt.expected, wrapped)
+		}
+	}
+
+	_, err := New(WithStrictUTF8()).Convert(strings.NewReader("abc\xff"), ioutil.Discard)
+	var invalid *InvalidUTF8Error
+	if !errors.As(fmt.Errorf("wrapped: %w", err), &invalid) || invalid.Offset != 3 {
+		t.Errorf("Expected an *InvalidUTF8Error at offset 3, got %v", err)
+	}
+	if !errors.Is(io.ErrShortWrite, ErrShortWrite) {
+		t.Errorf("Expected ErrShortWrite to be io.ErrShortWrite")
+	}
+}
+
+func TestBufferStats(t *testing.T) {
+	const size = 16
+	in := strings.Repeat("abcdefgh", 6)
+	tests := []struct {
+		opts     []Option
+		in       string
+		expected BufferStats
+	}{
+		{[]Option{WithBufferSize(size)}, in, BufferStats{Refills: 3, MaxFill: size, BytesRead: 3 * size}},
+		{[]Option{WithBufferSize(size), WithReadChunkSize(5)}, in, BufferStats{Refills: 10, MaxFill: 5, BytesRead: 3 * size}},
+		// the start of the smiley is kept for the next read
+		{[]Option{WithBufferSize(size), WithReadChunkSize(6)}, "abcd☺efgh", BufferStats{Refills: 2, MaxFill: 7, BytesRead: 11}},
+		{[]Option{WithBufferSize(size)}, "", BufferStats{}},
+	}
+	for _, tt := range tests {
+		converter := New(tt.opts...)
+		if _, err := converter.Convert(strings.NewReader(tt.in), ioutil.Discard); err != nil {
+			t.Fatalf("Converter failed: %v", err)
+		}
+		if stats := converter.BufferStats(); stats != tt.expected {
+			t.Errorf("Convert(%q): expected %+v, got %+v", tt.in, tt.expected, stats)
+		}
+	}
+
+	converter := New()
+	converter.Convert(strings.NewReader(in), ioutil.Discard)
+	converter.ConvertBytes([]byte(in), ioutil.Discard)
+	if stats := converter.BufferStats(); stats != (BufferStats{}) {
+		t.Errorf("Expected no buffer stats for ConvertBytes, got %+v", stats)
+	}
+}
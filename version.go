@@ -0,0 +1,139 @@
+package streamquote
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// headerVersion is the version of the escaping rules written in the
+// header of WithVersionHeader. It has to be incremented whenever the
+// output of a mode changes in a way the decoder of the previous version
+// can't read.
+const headerVersion = 1
+
+// The modes written in the header of WithVersionHeader.
+const (
+	// goMode is a double-quoted Go string literal, with or without the quotes
+	goMode = "go"
+	// percentMode is percent-encoded data
+	percentMode = "pct"
+)
+
+// maxHeaderLen is the longest header Unconvert reads.
+const maxHeaderLen = 32
+
+// ErrInvalidHeader is returned by Unconvert if the data doesn't start
+// with a header written by WithVersionHeader, or if the header has
+// a version or a mode it doesn't know.
+var ErrInvalidHeader = errors.New("streamquote: invalid version header")
+
+// ErrMalformed is returned by Unconvert if the data after the header
+// can't be decoded with the rules of its mode.
+var ErrMalformed = errors.New("streamquote: malformed converted data")
+
+// headerMode returns the mode of the header of WithVersionHeader,
+// or false if Unconvert can't decode the output of c.
+// The output has to be a Go string literal, or percent-encoded data,
+// with nothing around it, and with every byte of the input kept.
+func (c *Quoter) headerMode() (string, bool) {
+	switch {
+	case len(c.prefix) > 0 || len(c.suffix) > 0 || c.trailingNewline,
+		c.wrapCols > 0 || c.fixedWidth > 0 || c.framed,
+		c.stripBOM || c.normalizeNewlines,
+		c.escaper != nil || c.replacements != nil || c.invalidReplacement != nil:
+		return "", false
+	case c.percent:
+		return percentMode, !strings.Contains(c.percentSafe, "%")
+	}
+	goLiteral := c.delimiter == '"' && c.invalidUTF8 == EscapeHex &&
+		(c.style.hex == lowerhex || c.style.hex == upperhex) &&
+		c.style.prefix == GoPrefix && c.style.short == nil &&
+		!c.style.python && !c.style.js && !c.style.csv && !c.style.surrogatePairs &&
+		!c.byteSlice && c.byteRanges == nil && !c.html &&
+		c.alwaysEscape == nil && !c.nulShortForm && !c.escapeSurrogates &&
+		!c.literalWhitespace && c.tabWidth == 0 && !c.templateSafe
+	return goMode, goLiteral
+}
+
+// appendHeader appends the header of WithVersionHeader to dst.
+func appendHeader(dst []byte, mode string) []byte {
+	dst = append(dst, "sq"...)
+	dst = strconv.AppendInt(dst, headerVersion, 10)
+	dst = append(dst, ':')
+	dst = append(dst, mode...)
+	return append(dst, ':')
+}
+
+// Unconvert reads data written by a Quoter with WithVersionHeader
+// from "in", decoding it with the rules selected by its header, and
+// writes the original data to "out". It returns the number of bytes
+// written. It fails with an error wrapping ErrInvalidHeader if the data
+// doesn't start with a header it knows, and with an error wrapping
+// ErrMalformed if the rest of the data can't be decoded.
+// The data after the header is read into memory before decoding it.
+func Unconvert(in io.Reader, out io.Writer) (int, error) {
+	if in == nil {
+		return 0, ErrNilReader
+	}
+	if out == nil {
+		return 0, ErrNilWriter
+	}
+	r := bufio.NewReader(in)
+	mode, err := readHeader(r)
+	if err != nil {
+		return 0, err
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, fmt.Errorf("streamquote: read error: %w", err)
+	}
+	var decoded string
+	switch mode {
+	case goMode:
+		if len(body) >= 2 && body[0] == '"' && body[len(body)-1] == '"' {
+			// written with WithQuotes, the output without them
+			// never starts with a double quote
+			body = body[1 : len(body)-1]
+		}
+		decoded, err = strconv.Unquote(`"` + string(body) + `"`)
+	case percentMode:
+		decoded, err = url.PathUnescape(string(body))
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return io.WriteString(out, decoded)
+}
+
+// readHeader reads the header of WithVersionHeader from r,
+// and returns its mode.
+func readHeader(r *bufio.Reader) (string, error) {
+	header, err := r.Peek(maxHeaderLen)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("streamquote: read error: %w", err)
+	}
+	if !bytes.HasPrefix(header, []byte("sq")) {
+		return "", fmt.Errorf("%w: missing", ErrInvalidHeader)
+	}
+	fields := bytes.SplitN(header[len("sq"):], []byte(":"), 3)
+	if len(fields) < 3 {
+		return "", fmt.Errorf("%w: truncated", ErrInvalidHeader)
+	}
+	version, err := strconv.Atoi(string(fields[0]))
+	if err != nil || version != headerVersion {
+		return "", fmt.Errorf("%w: unknown version %q", ErrInvalidHeader, fields[0])
+	}
+	mode := string(fields[1])
+	if mode != goMode && mode != percentMode {
+		return "", fmt.Errorf("%w: unknown mode %q", ErrInvalidHeader, mode)
+	}
+	r.Discard(len("sq") + len(fields[0]) + len(fields[1]) + 2)
+	return mode, nil
+}
@@ -0,0 +1,88 @@
+package streamquote
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestVersionHeader(t *testing.T) {
+	inputs := []string{"", "abc", "\"\\", "a\nb\t\x00\x7f", "abc\xffdef\xe2\x98", "☺\U0010ffff­", "sq1:go:"}
+	optSets := [][]Option{
+		nil,
+		{WithQuotes()},
+		{WithASCII(), WithUppercaseHex()},
+		{WithGraphic(), WithQuotes()},
+		{WithMinimalEscaping()},
+		{WithPercentEncoding("/")},
+		{WithBufferSize(8)},
+		{WithVerifyGoLiteral(), WithQuotes()},
+	}
+	for _, opts := range optSets {
+		converter := New(append(opts, WithVersionHeader())...)
+		for _, in := range inputs {
+			out, err := converter.ConvertAll(strings.NewReader(in))
+			if err != nil {
+				t.Fatalf("Converter failed: %v", err)
+			}
+			var buffer bytes.Buffer
+			n, err := Unconvert(iotest.OneByteReader(bytes.NewReader(out)), &buffer)
+			if err != nil {
+				t.Fatalf("Unconvert(%q) failed: %v", out, err)
+			}
+			if buffer.String() != in || n != len(in) {
+				t.Errorf("Unconvert(%q) = %d, %q, want %d, %q", out, n, buffer.String(), len(in), in)
+			}
+		}
+	}
+
+	out, err := New(WithVersionHeader(), WithQuotes()).ConvertAll(strings.NewReader("a\n"))
+	if err != nil {
+		t.Fatalf("Converter failed: %v", err)
+	}
+	if expected := `sq1:go:"a\n"`; string(out) != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+
+	// the mode of the header selects the rules: decoded as percent-encoded
+	// data, a Go string literal turns into something else
+	var buffer bytes.Buffer
+	if _, err := Unconvert(strings.NewReader(`sq1:pct:a%2Fb\x41`), &buffer); err != nil {
+		t.Fatalf("Unconvert failed: %v", err)
+	}
+	if expected := `a/b\x41`; buffer.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buffer.String())
+	}
+}
+
+func TestVersionHeaderErrors(t *testing.T) {
+	for _, opts := range [][]Option{
+		{WithPrefix([]byte("x = "))},
+		{WithInvalidUTF8(Drop)},
+		{WithPython()},
+		{WithDelimiter('\'')},
+		{WithLineWrap(10, "")},
+		{WithPercentEncoding("%")},
+		{WithByteSlice()},
+	} {
+		_, err := New(append(opts, WithVersionHeader())...).ConvertAll(strings.NewReader("abc"))
+		if !errors.Is(err, ErrConflictingOptions) {
+			t.Errorf("Expected %v, got %v", ErrConflictingOptions, err)
+		}
+	}
+
+	for _, in := range []string{"", "abc", "sq1", "sq1:go", "sq2:go:abc", "sqx:go:abc", "sq1:py:abc"} {
+		var buffer bytes.Buffer
+		if _, err := Unconvert(strings.NewReader(in), &buffer); !errors.Is(err, ErrInvalidHeader) {
+			t.Errorf("Unconvert(%q) returned %v, want %v", in, err, ErrInvalidHeader)
+		}
+	}
+	for _, in := range []string{`sq1:go:\q`, `sq1:go:"abc`, "sq1:go:a\nb", "sq1:pct:%zz"} {
+		var buffer bytes.Buffer
+		if _, err := Unconvert(strings.NewReader(in), &buffer); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Unconvert(%q) returned %v, want %v", in, err, ErrMalformed)
+		}
+	}
+}
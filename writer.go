@@ -0,0 +1,157 @@
+package streamquote
+
+import (
+	"errors"
+	"io"
+	"unicode/utf8"
+)
+
+// ErrClosed is returned by Writer's methods after it has been closed.
+var ErrClosed = errors.New("streamquote: writer closed")
+
+// Writer is an io.WriteCloser that converts the data written to it,
+// and writes the converted data to an underlying writer.
+// Runes may be split across Write calls, the bytes of an incomplete rune
+// are kept until the next Write completes it.
+// The converted data is buffered, call Flush or Close to write it out.
+// It is not safe for concurrent use.
+type Writer struct {
+	c       *Quoter
+	out     io.Writer
+	started bool
+	closed  bool
+	err     error
+	// carry holds the bytes of an incomplete rune from the previous Write,
+	// and enough room to complete it.
+	carry    [2 * utf8.UTFMax]byte
+	carryLen int
+	// strBuf holds the parts of the strings passed to WriteString
+	strBuf [512]byte
+}
+
+var (
+	_ io.WriteCloser  = (*Writer)(nil)
+	_ io.StringWriter = (*Writer)(nil)
+	_ io.ByteWriter   = (*Writer)(nil)
+)
+
+// NewWriter returns a new Writer configured by opts,
+// that writes the converted data to out.
+func NewWriter(out io.Writer, opts ...Option) *Writer {
+	return &Writer{
+		c:   newConverter(opts...),
+		out: out,
+	}
+}
+
+// start starts the conversion on first use,
+// and returns any error that stopped it.
+func (w *Writer) start() error {
+	if w.closed {
+		return ErrClosed
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if !w.started {
+		w.started = true
+		w.err = w.c.begin(w.out)
+	}
+	return w.err
+}
+
+// Write converts p, and writes the converted data to the underlying writer.
+func (w *Writer) Write(p []byte) (int, error) {
+	if err := w.start(); err != nil {
+		return 0, err
+	}
+	n := 0
+	if w.carryLen > 0 {
+		// complete the incomplete rune from the previous call
+		carried := w.carryLen
+		k := copy(w.carry[carried:], p)
+		processed, err := w.c.convertData(w.carry[:carried+k], false)
+		if err != nil {
+			w.err = err
+			return 0, err
+		}
+		if processed < carried {
+			// still incomplete, all of p went into carry
+			w.carryLen = copy(w.carry[:], w.carry[processed:carried+k])
+			return len(p), nil
+		}
+		w.carryLen = 0
+		n = processed - carried
+	}
+	processed, err := w.c.convertData(p[n:], false)
+	n += processed
+	if err != nil {
+		w.err = err
+		return n, err
+	}
+	w.carryLen = copy(w.carry[:], p[n:])
+	w.c.reportProgress()
+	return len(p), nil
+}
+
+// WriteString converts s like Write, without converting all of it to
+// a byte slice first.
+func (w *Writer) WriteString(s string) (int, error) {
+	if err := w.start(); err != nil {
+		return 0, err
+	}
+	n := 0
+	for n < len(s) {
+		k := copy(w.strBuf[:], s[n:])
+		written, err := w.Write(w.strBuf[:k])
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// WriteByte converts b like Write, for producers that write one byte
+// at a time. The bytes of a multi-byte rune are kept until it's complete.
+func (w *Writer) WriteByte(b byte) error {
+	if err := w.start(); err != nil {
+		return err
+	}
+	w.carry[w.carryLen] = b
+	w.carryLen++
+	processed, err := w.c.convertData(w.carry[:w.carryLen], false)
+	if err != nil {
+		w.err = err
+		return err
+	}
+	w.carryLen = copy(w.carry[:], w.carry[processed:w.carryLen])
+	w.c.reportProgress()
+	return nil
+}
+
+// Flush writes any buffered converted data to the underlying writer.
+// The bytes of an incomplete rune are kept until the next Write or Close.
+func (w *Writer) Flush() error {
+	if err := w.start(); err != nil {
+		return err
+	}
+	w.err = w.c.flush()
+	return w.err
+}
+
+// Close converts the remaining data, and flushes the converted data
+// to the underlying writer. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	err := w.start()
+	if err == nil && w.carryLen > 0 {
+		_, err = w.c.convertFinal(w.carry[:w.carryLen])
+		w.carryLen = 0
+	}
+	if w.closed {
+		return err
+	}
+	w.closed = true
+	_, err = w.c.end(err)
+	return err
+}
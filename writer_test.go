@@ -0,0 +1,219 @@
+package streamquote
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	for _, tt := range quotetests {
+		var buffer bytes.Buffer
+		w := NewWriter(&buffer)
+		if _, err := w.Write([]byte(tt.in)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		expected := tt.out[1 : len(tt.out)-1]
+		if out := buffer.String(); !testEqual(out, expected) {
+			t.Errorf("Quote(%s) = %s, want %s", tt.in, out, expected)
+		}
+	}
+}
+
+// TestWriterSplitRune tests that a rune split across
+// two Write calls is converted correctly.
+func TestWriterSplitRune(t *testing.T) {
+	in := []byte("a☺b")
+	for i := 1; i < len(in); i++ {
+		var buffer bytes.Buffer
+		w := NewWriter(&buffer)
+		w.Write(in[:i])
+		w.Write(in[i:])
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		if out := buffer.String(); out != "a☺b" {
+			t.Errorf("Split at %d: expected %q, got %q", i, "a☺b", out)
+		}
+	}
+}
+
+// TestWriterBytewise tests writing the input one byte at a time.
+func TestWriterBytewise(t *testing.T) {
+	in := "abc\xff\xe2\x82\U0010ffff☺\xf0\x9f\x98\xe2\x82"
+	expected := strconv.Quote(in)
+
+	var buffer bytes.Buffer
+	w := NewWriter(&buffer, WithQuotes())
+	for i := 0; i < len(in); i++ {
+		n, err := w.Write([]byte{in[i]})
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if n != 1 {
+			t.Fatalf("Expected Write to return 1, got %d", n)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if out := buffer.String(); out != expected {
+		t.Errorf("Expected %s, got %s", expected, out)
+	}
+}
+
+func TestWriterFlush(t *testing.T) {
+	var buffer bytes.Buffer
+	w := NewWriter(&buffer)
+	w.Write([]byte("a\n\xe2\x98"))
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if out := buffer.String(); out != `a\n` {
+		t.Errorf("Expected %s, got %s", `a\n`, out)
+	}
+	w.Write([]byte("\xba"))
+	w.Close()
+	if out := buffer.String(); out != "a\\n☺" {
+		t.Errorf("Expected %s, got %s", "a\\n☺", out)
+	}
+}
+
+// TestWriterCloseIncomplete tests that Close escapes the bytes
+// of an incomplete rune at the end of the input.
+func TestWriterCloseIncomplete(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"\xe2", `\xe2`},
+		{"a\xe2\x98", `a\xe2\x98`},
+		{"\xf0\x9f\x98", `\xf0\x9f\x98`},
+	}
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		w := NewWriter(&buffer)
+		if _, err := w.Write([]byte(tt.in)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		if out := buffer.String(); out != tt.expected {
+			t.Errorf("Write(%q) = %s, want %s", tt.in, out, tt.expected)
+		}
+	}
+}
+
+func TestWriterWriteString(t *testing.T) {
+	in := "a☺b" + strings.Repeat("x\xff\U0010ffff", 300)
+	expected := strconv.Quote(in)
+	for i := 0; i < 8; i++ {
+		var buffer bytes.Buffer
+		w := NewWriter(&buffer, WithQuotes())
+		// alternate between Write and WriteString, splitting the runes
+		for j := 0; j < len(in); j += i + 1 {
+			end := j + i + 1
+			if end > len(in) {
+				end = len(in)
+			}
+			var err error
+			if (j/(i+1))%2 == 0 {
+				_, err = w.Write([]byte(in[j:end]))
+			} else {
+				_, err = io.WriteString(w, in[j:end])
+			}
+			if err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+		if _, err := w.WriteString(in); err != nil {
+			t.Fatalf("WriteString failed: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		if out, expected := buffer.String(), expected[:len(expected)-1]+expected[1:]; out != expected {
+			t.Errorf("Chunks of %d: expected %s, got %s", i+1, expected, out)
+		}
+	}
+
+	w := NewWriter(ioutil.Discard)
+	allocs := testing.AllocsPerRun(10, func() {
+		w.WriteString(in)
+	})
+	if allocs != 0 {
+		t.Errorf("Expected no allocations, got %v", allocs)
+	}
+	w.Close()
+	if _, err := w.WriteString(""); err != ErrClosed {
+		t.Errorf("Expected %v, got %v", ErrClosed, err)
+	}
+}
+
+func TestWriterWriteByte(t *testing.T) {
+	inputs := []string{"abc\xff\xe2\x82\U0010ffff☺\xf0\x9f\x98\xe2\x82", "\ufeff\r\n\x001☺"}
+	for _, tt := range quotetests {
+		inputs = append(inputs, tt.in)
+	}
+	for _, opts := range [][]Option{{WithQuotes()}, {WithStripBOM(), WithNormalizeNewlines(), WithNulShortForm()}} {
+		converter := New(opts...)
+		for _, in := range inputs {
+			expected, err := converter.ConvertAll(strings.NewReader(in))
+			if err != nil {
+				t.Fatalf("Converter failed: %v", err)
+			}
+			var buffer bytes.Buffer
+			w := NewWriter(&buffer, opts...)
+			for i := 0; i < len(in); i++ {
+				if err := w.WriteByte(in[i]); err != nil {
+					t.Fatalf("WriteByte failed: %v", err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			if out := buffer.String(); out != string(expected) {
+				t.Errorf("WriteByte of %q: expected %s, got %s", in, expected, out)
+			}
+		}
+	}
+
+	w := NewWriter(ioutil.Discard)
+	in := "a☺\xff"
+	allocs := testing.AllocsPerRun(10, func() {
+		for i := 0; i < len(in); i++ {
+			w.WriteByte(in[i])
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("Expected no allocations, got %v", allocs)
+	}
+	w.Close()
+	if err := w.WriteByte('a'); err != ErrClosed {
+		t.Errorf("Expected %v, got %v", ErrClosed, err)
+	}
+}
+
+func TestWriterClosed(t *testing.T) {
+	var buffer bytes.Buffer
+	w := NewWriter(&buffer, WithQuotes())
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if out := buffer.String(); out != `""` {
+		t.Errorf("Expected %s, got %s", `""`, out)
+	}
+	if _, err := w.Write([]byte("a")); err != ErrClosed {
+		t.Errorf("Expected %v, got %v", ErrClosed, err)
+	}
+	if err := w.Close(); err != ErrClosed {
+		t.Errorf("Expected %v, got %v", ErrClosed, err)
+	}
+}